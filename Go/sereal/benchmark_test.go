@@ -31,9 +31,224 @@ var solarSystem = map[string]interface{}{
 	},
 }
 
+// solarSystemPlanets returns the planets of solarSystem as typed structs
+func solarSystemPlanets() []RefPlanet {
+	var planets []RefPlanet
+	for _, p := range solarSystem["planets"].([]struct {
+		pos                int
+		name               string
+		mass_earths        float64
+		notable_satellites []string
+	}) {
+		planets = append(planets, RefPlanet{p.pos, p.name, p.mass_earths, p.notable_satellites})
+	}
+
+	return planets
+}
+
+// request is a typical RPC request made of generic maps, slices and scalars
+var request = map[string]interface{}{
+	"id":     123456789,
+	"method": "users.search",
+	"params": map[string]interface{}{
+		"query":   "name:Foo*",
+		"fields":  []interface{}{"id", "name", "email", "created"},
+		"limit":   100,
+		"offset":  0,
+		"timeout": 1.5,
+	},
+	"client": map[string]interface{}{
+		"name":    "sereal-bench",
+		"version": "1.0.0",
+	},
+}
+
+func BenchmarkEncodeRequest(b *testing.B) {
+	enc := sereal.NewEncoderV3()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := enc.Marshal(request)
+		if err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+func BenchmarkEncodeRequestAppend(b *testing.B) {
+	enc := sereal.NewEncoderV3()
+
+	var buf []byte
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		buf, err = enc.MarshalAppend(buf[:0], nil, request)
+		if err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+func BenchmarkEncodeGenerated(b *testing.B) {
+	enc := sereal.NewEncoderV3()
+	gen := newGenRequest()
+
+	var buf []byte
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		buf, err = enc.MarshalAppend(buf[:0], nil, &gen)
+		if err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+func BenchmarkEncodeReflection(b *testing.B) {
+	enc := sereal.NewEncoderV3()
+	gen := newGenRequest()
+	ref := (*RefRequest)(&gen)
+
+	var buf []byte
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		buf, err = enc.MarshalAppend(buf[:0], nil, ref)
+		if err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+func BenchmarkEncodePlanetsGenerated(b *testing.B) {
+	enc := sereal.NewEncoderV3()
+
+	var planets []GenPlanet
+	for _, p := range solarSystemPlanets() {
+		planets = append(planets, GenPlanet(p))
+	}
+
+	var buf []byte
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		buf, err = enc.MarshalAppend(buf[:0], nil, planets)
+		if err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+func BenchmarkEncodePlanetsReflection(b *testing.B) {
+	enc := sereal.NewEncoderV3()
+	planets := solarSystemPlanets()
+
+	var buf []byte
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		buf, err = enc.MarshalAppend(buf[:0], nil, planets)
+		if err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+func BenchmarkEncodeSolarSystemGenerated(b *testing.B) {
+	enc := sereal.NewEncoderV3()
+	gen := newGenSolarSystem()
+
+	var buf []byte
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		buf, err = enc.MarshalAppend(buf[:0], nil, &gen)
+		if err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+func BenchmarkEncodeSolarSystemReflection(b *testing.B) {
+	enc := sereal.NewEncoderV3()
+	gen := newGenSolarSystem()
+	ref := refSolarSystem(&gen)
+
+	var buf []byte
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		buf, err = enc.MarshalAppend(buf[:0], nil, ref)
+		if err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+func BenchmarkDecodeGenerated(b *testing.B) {
+	gen := newGenRequest()
+	buf, _ := sereal.Marshal(&gen)
+	dec := sereal.NewDecoder()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var v GenRequest
+		if err := dec.Unmarshal(buf, &v); err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+func BenchmarkDecodeReflection(b *testing.B) {
+	gen := newGenRequest()
+	buf, _ := sereal.Marshal(&gen)
+	dec := sereal.NewDecoder()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var v RefRequest
+		if err := dec.Unmarshal(buf, &v); err != nil {
+			b.FailNow()
+		}
+	}
+}
+
+// TestDecodeGeneratedFaster fails if generated code decodes slower than
+// reflection, which it's there to beat
+func TestDecodeGeneratedFaster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping benchmarks in short mode")
+	}
+
+	gen := testing.Benchmark(BenchmarkDecodeGenerated)
+	ref := testing.Benchmark(BenchmarkDecodeReflection)
+
+	if gen.NsPerOp() >= ref.NsPerOp() || gen.AllocsPerOp() > ref.AllocsPerOp() {
+		t.Errorf("generated code decodes slower than reflection:\ngenerated : %s %s\nreflection: %s %s", gen, gen.MemString(), ref, ref.MemString())
+	}
+}
+
 func BenchmarkEncodeComplexDataWithHeader(b *testing.B) {
 	enc := sereal.NewEncoderV3()
 
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		_, err := enc.MarshalWithHeader(solarSystemMeta, solarSystem)
@@ -43,6 +258,22 @@ func BenchmarkEncodeComplexDataWithHeader(b *testing.B) {
 	}
 }
 
+func BenchmarkEncodeComplexDataWithHeaderAppend(b *testing.B) {
+	enc := sereal.NewEncoderV3()
+
+	var buf []byte
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		buf, err = enc.MarshalAppend(buf[:0], solarSystemMeta, solarSystem)
+		if err != nil {
+			b.FailNow()
+		}
+	}
+}
+
 func BenchmarkEncodeAndSnappyComplexDataWithHeader(b *testing.B) {
 	enc := sereal.NewEncoderV3()
 	enc.Compression = sereal.SnappyCompressor{Incremental: true}
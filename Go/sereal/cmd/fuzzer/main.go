@@ -1,31 +1,51 @@
+// Command fuzzer decodes random documents until the decoder panics, and
+// prints the document which made it.  The fuzz targets of the sereal package
+// do the same guided by coverage: go test -fuzz FuzzDecoder
 package main
 
 import (
 	crand "crypto/rand"
 	"encoding/hex"
 	"fmt"
-	"github.com/Sereal/Sereal/Go/sereal"
 	mrand "math/rand"
+	"os"
+
+	"github.com/Sereal/Sereal/Go/sereal"
 )
 
 func main() {
 
 	srlHeader, _ := hex.DecodeString("3d73726c0100")
 
-        var decoder sereal.Decoder
-        decoder.PerlCompat = true
+	var decoder sereal.Decoder
+	decoder.PerlCompat = true
 
 	for {
-            l := len(srlHeader) + mrand.Intn(200)
-            b := make([]byte, l)
-            crand.Read(b)
-            doc := make([]byte, l + len(srlHeader))
-            copy(doc, srlHeader)
-            copy(doc[6:], b)
-            fmt.Println(hex.Dump(doc))
-            var m interface{}
-            err := decoder.Unmarshal(doc, &m)
-            fmt.Println("err=", err)
+		l := len(srlHeader) + mrand.Intn(200)
+		b := make([]byte, l)
+		crand.Read(b)
+		doc := make([]byte, l+len(srlHeader))
+		copy(doc, srlHeader)
+		copy(doc[6:], b)
+
+		unmarshal(&decoder, doc)
 	}
+}
+
+// unmarshal decodes doc, exiting with the document and the panic if the
+// decoder didn't return an error instead
+func unmarshal(decoder *sereal.Decoder, doc []byte) {
+	// decoding may uncompress into doc
+	dump := hex.Dump(doc)
+
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println(dump)
+			fmt.Println("panic:", r)
+			os.Exit(1)
+		}
+	}()
 
+	var m interface{}
+	decoder.Unmarshal(doc, &m)
 }
@@ -0,0 +1,770 @@
+// Command serealgen generates MarshalSereal and UnmarshalSereal methods for
+// struct types.  They encode and decode the structs exactly like the sereal
+// package does via reflection, which it skips for types having them.
+//
+// Usage:
+//
+//	serealgen [-type T,...] [-output file] [directory | files...]
+//
+// By default all struct types of the package in the current directory are
+// generated for, into <package>_sereal.go.  Types implementing Marshaler,
+// encoding.BinaryMarshaler or encoding.TextMarshaler are skipped, since the
+// sereal package uses those methods instead.  A typical use is
+//
+//	//go:generate serealgen -type Request,Response
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const serealPkg = "github.com/Sereal/Sereal/Go/sereal"
+
+var (
+	typeNames = flag.String("type", "", "comma-separated list of struct types; all struct types if empty")
+	output    = flag.String("output", "", "output file name; default <package>_sereal.go, or <type>_sereal.go for a single type")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: serealgen [-type T,...] [-output file] [directory | files...]\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("serealgen: ")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+
+	var dir string
+	var files []string
+
+	if len(args) == 1 && isDirectory(args[0]) {
+		dir = args[0]
+		matches, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, m := range matches {
+			if !strings.HasSuffix(m, "_test.go") {
+				files = append(files, m)
+			}
+		}
+	} else {
+		dir = filepath.Dir(args[0])
+		files = args
+	}
+
+	var names []string
+	if *typeNames != "" {
+		names = strings.Split(*typeNames, ",")
+	}
+
+	outName := *output
+	if outName != "" && !filepath.IsAbs(outName) && !strings.ContainsRune(outName, filepath.Separator) {
+		outName = filepath.Join(dir, outName)
+	}
+
+	g := &generator{}
+	pkgName := g.load(files, outName)
+
+	if outName == "" {
+		base := pkgName
+		if len(names) == 1 {
+			base = strings.ToLower(names[0])
+		}
+		outName = filepath.Join(dir, base+"_sereal.go")
+	}
+
+	src, err := g.generate(pkgName, names)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(outName, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func isDirectory(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.IsDir()
+}
+
+type generator struct {
+	pkg   *types.Package
+	types map[*types.TypeName]bool // struct types generated for
+	buf   bytes.Buffer
+
+	needSort    bool
+	needStrconv bool
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// load parses and type checks files, skipping the previously generated output
+func (g *generator) load(files []string, outName string) string {
+	fset := token.NewFileSet()
+
+	var parsed []*ast.File
+	for _, name := range files {
+		if outName != "" && filepath.Clean(name) == filepath.Clean(outName) {
+			continue
+		}
+
+		f, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if isGenerated(f) {
+			continue
+		}
+
+		parsed = append(parsed, f)
+	}
+
+	if len(parsed) == 0 {
+		log.Fatal("no Go files found")
+	}
+
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		// types from packages which can't be imported are only
+		// needed for omitempty and the string option
+		Error: func(error) {},
+	}
+
+	g.pkg, _ = conf.Check(parsed[0].Name.Name, fset, parsed, nil)
+	return g.pkg.Name()
+}
+
+// isGenerated reports whether f is the output of serealgen
+func isGenerated(f *ast.File) bool {
+	for _, c := range f.Comments {
+		if c.Pos() > f.Package {
+			break
+		}
+
+		if strings.HasPrefix(c.Text(), "Code generated by serealgen") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// structTypes returns the struct types to generate methods for
+func (g *generator) structTypes(names []string) ([]*types.TypeName, error) {
+	scope := g.pkg.Scope()
+
+	if names == nil {
+		for _, name := range scope.Names() {
+			if tn, ok := scope.Lookup(name).(*types.TypeName); ok && !tn.IsAlias() && canGenerate(tn) == nil {
+				names = append(names, name)
+			}
+		}
+	}
+
+	var list []*types.TypeName
+	for _, name := range names {
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok {
+			return nil, fmt.Errorf("type %s not found", name)
+		}
+
+		if err := canGenerate(tn); err != nil {
+			return nil, err
+		}
+
+		list = append(list, tn)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Pos() < list[j].Pos() })
+	return list, nil
+}
+
+// canGenerate returns why no methods can be generated for tn, if so
+func canGenerate(tn *types.TypeName) error {
+	named, ok := tn.Type().(*types.Named)
+	if !ok {
+		return fmt.Errorf("%s is not a named type", tn.Name())
+	}
+
+	if _, ok := named.Underlying().(*types.Struct); !ok {
+		return fmt.Errorf("%s is not a struct type", tn.Name())
+	}
+
+	if named.TypeParams().Len() > 0 {
+		return fmt.Errorf("%s is a generic type", tn.Name())
+	}
+
+	if _, err := structFields(tn); err != nil {
+		return err
+	}
+
+	ms := types.NewMethodSet(types.NewPointer(named))
+	for _, m := range []string{"MarshalSereal", "UnmarshalSereal", "MarshalBinary", "UnmarshalBinary", "MarshalText", "UnmarshalText"} {
+		if ms.Lookup(tn.Pkg(), m) != nil {
+			return fmt.Errorf("%s already has a %s method", tn.Name(), m)
+		}
+	}
+
+	return nil
+}
+
+func (g *generator) generate(pkgName string, names []string) ([]byte, error) {
+	list, err := g.structTypes(names)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no struct types found")
+	}
+
+	g.types = make(map[*types.TypeName]bool)
+	for _, tn := range list {
+		g.types[tn] = true
+	}
+
+	for _, tn := range list {
+		fields, err := structFields(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		g.genMarshal(tn, fields)
+		g.genUnmarshal(tn, fields)
+	}
+
+	body := g.buf.Bytes()
+	g.buf = bytes.Buffer{}
+
+	g.printf("// Code generated by serealgen. DO NOT EDIT.\n\n")
+	g.printf("package %s\n\n", pkgName)
+	g.printf("import (\n")
+	if g.needSort {
+		g.printf("\t\"sort\"\n")
+	}
+	if g.needStrconv {
+		g.printf("\t\"strconv\"\n")
+	}
+	g.printf("\t\"strings\"\n\n")
+	g.printf("\t%q\n", serealPkg)
+	g.printf(")\n\n")
+	g.buf.Write(body)
+
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting generated code: %v", err)
+	}
+
+	return src, nil
+}
+
+// field is a struct field encoded as a hash entry, see the sereal package's
+// structField
+type field struct {
+	name      string // hash key
+	goName    string // selector, via embedded structs
+	index     []int
+	tagged    bool
+	typ       types.Type
+	omitEmpty bool
+	asString  bool
+	binary    bool
+	utf8      bool
+}
+
+// structFields returns the encoded fields of tn in declaration order, with
+// those of embedded structs promoted like the sereal package does
+func structFields(tn *types.TypeName) ([]field, error) {
+	type embedded struct {
+		st     *types.Struct
+		goName string
+		index  []int
+	}
+
+	var list []field
+
+	next := []embedded{{st: tn.Type().Underlying().(*types.Struct)}}
+	visited := make(map[*types.Struct]bool)
+
+	for len(next) > 0 {
+		current := next
+		next = nil
+
+		count := make(map[*types.Struct]int)
+		for _, em := range current {
+			count[em.st]++
+		}
+
+		for _, em := range current {
+			if visited[em.st] {
+				continue
+			}
+			visited[em.st] = true
+
+			for i := 0; i < em.st.NumFields(); i++ {
+				v := em.st.Field(i)
+
+				ft := v.Type()
+				ptr, isPtr := ft.(*types.Pointer)
+				if isPtr {
+					ft = ptr.Elem()
+				}
+				est, isStruct := ft.Underlying().(*types.Struct)
+
+				if !v.Exported() && (!v.Embedded() || !isStruct || isPtr) {
+					continue
+				}
+
+				tag := reflect.StructTag(em.st.Tag(i)).Get("sereal")
+				if tag == "-" {
+					continue
+				}
+
+				index := append(append([]int(nil), em.index...), i)
+				goName := em.goName + v.Name()
+
+				opts := strings.Split(tag, ",")
+
+				if b, ok := ft.Underlying().(*types.Basic); ok && b.Kind() == types.Invalid && v.Embedded() && opts[0] == "" {
+					return nil, fmt.Errorf("%s.%s: can't resolve the type of the embedded field", tn.Name(), goName)
+				}
+
+				if opts[0] == "" && v.Embedded() && isStruct {
+					if isPtr {
+						return nil, fmt.Errorf("%s.%s: embedded pointers are not supported", tn.Name(), goName)
+					}
+
+					next = append(next, embedded{est, goName + ".", index})
+					continue
+				}
+
+				if !v.Exported() {
+					continue
+				}
+
+				f := field{name: v.Name(), goName: goName, index: index, typ: v.Type()}
+
+				if opts[0] != "" {
+					f.name = opts[0]
+					f.tagged = true
+				}
+
+				for _, opt := range opts[1:] {
+					if b, ok := f.typ.Underlying().(*types.Basic); ok && b.Kind() == types.Invalid {
+						return nil, fmt.Errorf("%s.%s: can't resolve the type of the field for its %s option", tn.Name(), goName, opt)
+					}
+
+					switch opt {
+					case "omitempty":
+						f.omitEmpty = true
+					case "string":
+						f.asString = stringableKind(f.typ) != 0
+					case "binary":
+						f.binary = isString(f.typ.Underlying())
+					case "utf8":
+						f.utf8 = isByteSlice(f.typ.Underlying())
+					}
+				}
+
+				list = append(list, f)
+				if count[em.st] > 1 {
+					// embedded more than once at this depth, so ambiguous
+					list = append(list, f)
+				}
+			}
+		}
+	}
+
+	// group the fields by name, the dominant one first
+	sort.SliceStable(list, func(i, j int) bool {
+		x, y := &list[i], &list[j]
+		if x.name != y.name {
+			return x.name < y.name
+		}
+		if len(x.index) != len(y.index) {
+			return len(x.index) < len(y.index)
+		}
+		return x.tagged && !y.tagged
+	})
+
+	out := list[:0]
+	for i := 0; i < len(list); {
+		j := i + 1
+		for j < len(list) && list[j].name == list[i].name {
+			j++
+		}
+
+		// a tie between the shallowest fields hides all of them
+		if j == i+1 || len(list[i+1].index) > len(list[i].index) || list[i].tagged && !list[i+1].tagged {
+			out = append(out, list[i])
+		}
+
+		i = j
+	}
+
+	// back to declaration order
+	sort.Slice(out, func(i, j int) bool {
+		x, y := out[i].index, out[j].index
+		for k := 0; k < len(x) && k < len(y); k++ {
+			if x[k] != y[k] {
+				return x[k] < y[k]
+			}
+		}
+		return len(x) < len(y)
+	})
+
+	return out, nil
+}
+
+// structClass returns the class tn is blessed into, named by the tag of a
+// blank field or else by the type
+func structClass(tn *types.TypeName) string {
+	st := tn.Type().Underlying().(*types.Struct)
+	for i := 0; i < st.NumFields(); i++ {
+		if class := reflect.StructTag(st.Tag(i)).Get("sereal"); st.Field(i).Name() == "_" && class != "" {
+			return class
+		}
+	}
+
+	return tn.Name()
+}
+
+// stringableKind returns the basic kind of the numeric or boolean type t, or 0
+func stringableKind(t types.Type) types.BasicKind {
+	b, ok := t.Underlying().(*types.Basic)
+	if !ok || b.Kind() == types.Uintptr {
+		return 0
+	}
+
+	if b.Info()&(types.IsBoolean|types.IsInteger|types.IsFloat) != 0 && b.Info()&types.IsUntyped == 0 {
+		return b.Kind()
+	}
+
+	return 0
+}
+
+func isString(t types.Type) bool {
+	b, ok := t.(*types.Basic)
+	return ok && b.Kind() == types.String
+}
+
+func isByteSlice(t types.Type) bool {
+	s, ok := t.(*types.Slice)
+	if !ok {
+		return false
+	}
+
+	b, ok := s.Elem().Underlying().(*types.Basic)
+	return ok && b.Kind() == types.Uint8
+}
+
+// isBytes reports whether t is []byte, which unlike other byte slice types is
+// encoded as binary data
+func isBytes(t types.Type) bool {
+	return types.Identical(t, types.NewSlice(types.Typ[types.Byte]))
+}
+
+// basicKind returns the kind of t if it's a predeclared type, or 0
+func basicKind(t types.Type) types.BasicKind {
+	if b, ok := t.(*types.Basic); ok {
+		return b.Kind()
+	}
+
+	return 0
+}
+
+func isSigned(k types.BasicKind) bool {
+	return k >= types.Int && k <= types.Int64
+}
+
+func isUnsigned(k types.BasicKind) bool {
+	return k >= types.Uint && k <= types.Uint64
+}
+
+// emptyCheck returns the condition under which x is empty for omitempty, or
+// not empty if empty is false.  It returns "" if x can never be empty.
+func emptyCheck(x string, t types.Type, empty bool) string {
+	eq, not := " == ", "!"
+	if !empty {
+		eq, not = " != ", ""
+	}
+
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Info()&types.IsString != 0:
+			return "len(" + x + ")" + eq + "0"
+		case u.Info()&types.IsBoolean != 0:
+			return not + x
+		case u.Info()&types.IsNumeric != 0:
+			return x + eq + "0"
+		}
+	case *types.Slice, *types.Map, *types.Array:
+		return "len(" + x + ")" + eq + "0"
+	case *types.Pointer, *types.Interface:
+		return x + eq + "nil"
+	}
+
+	return ""
+}
+
+// convert returns x converted to the predeclared type to, unless it's of that
+// type already
+func convert(x string, t types.Type, to types.BasicKind) string {
+	if basicKind(t) == to {
+		return x
+	}
+
+	return types.Typ[to].Name() + "(" + x + ")"
+}
+
+func (g *generator) genMarshal(tn *types.TypeName, fields []field) {
+	g.printf("// MarshalSereal implements sereal.StructMarshaler\n")
+	g.printf("func (v *%s) MarshalSereal(w *sereal.Writer) error {\n", tn.Name())
+
+	g.printf("n := %d\n", len(fields))
+	for _, f := range fields {
+		if cond := emptyCheck("v."+f.goName, f.typ, true); f.omitEmpty && cond != "" {
+			g.printf("if %s {\nn--\n}\n", cond)
+		}
+	}
+	g.printf("\n")
+
+	g.printf("w.BeginObject(%q, n)\n", structClass(tn))
+
+	for _, f := range fields {
+		g.printf("\n")
+
+		cond := emptyCheck("v."+f.goName, f.typ, false)
+		if f.omitEmpty && cond != "" {
+			g.printf("if %s {\n", cond)
+		}
+
+		g.printf("w.Key(%q)\n", f.name)
+		g.genWriteField(f)
+
+		if f.omitEmpty && cond != "" {
+			g.printf("}\n")
+		}
+	}
+
+	g.printf("\nreturn nil\n}\n\n")
+}
+
+func (g *generator) genWriteField(f field) {
+	x := "v." + f.goName
+
+	switch {
+	case f.asString:
+		k := stringableKind(f.typ)
+		switch {
+		case k == types.Bool:
+			g.printf("if %s {\nw.String(\"1\")\n} else {\nw.String(\"\")\n}\n", x)
+		case isSigned(k):
+			g.printf("w.String(strconv.FormatInt(%s, 10))\n", convert(x, f.typ, types.Int64))
+		case isUnsigned(k):
+			g.printf("w.String(strconv.FormatUint(%s, 10))\n", convert(x, f.typ, types.Uint64))
+		case k == types.Float32:
+			g.printf("w.String(strconv.FormatFloat(float64(%s), 'g', -1, 32))\n", x)
+		default:
+			g.printf("w.String(strconv.FormatFloat(%s, 'g', -1, 64))\n", convert(x, f.typ, types.Float64))
+		}
+		g.needStrconv = true
+		return
+
+	case f.binary:
+		g.printf("w.BinaryString(%s)\n", convert(x, f.typ, types.String))
+		return
+
+	case f.utf8:
+		g.printf("w.String(string(%s))\n", x)
+		return
+	}
+
+	if call := writeCall(x, f.typ); call != "" {
+		g.printf("%s\n", call)
+		return
+	}
+
+	switch t := f.typ.(type) {
+	case *types.Named:
+		if g.isGenerated(t) {
+			g.printf("if err := w.Struct(&%s); err != nil {\nreturn err\n}\n", x)
+			return
+		}
+
+	case *types.Slice:
+		if g.canWriteElem(t.Elem()) {
+			g.printf("if w.BeginArray(&%s) {\n", x)
+			if writeCall("e", t.Elem()) != "" {
+				g.printf("for _, e := range %s {\n", x)
+				g.genWriteElem("e", t.Elem(), "StructElem", "i")
+			} else {
+				g.printf("for i := range %s {\n", x)
+				g.genWriteElem(x+"[i]", t.Elem(), "StructElem", "i")
+			}
+			g.printf("}\nif err := w.End(); err != nil {\nreturn err\n}\n}\n")
+			return
+		}
+
+	case *types.Map:
+		if basicKind(t.Key()) == types.String && g.canWriteElem(t.Elem()) {
+			g.printf("if w.BeginHash(&%s) {\n", x)
+			g.printf("if w.Canonical() {\n")
+			g.printf("keys := make([]string, 0, len(%s))\n", x)
+			g.printf("for k := range %s {\nkeys = append(keys, k)\n}\n", x)
+			g.printf("sort.Strings(keys)\n")
+			g.printf("for _, k := range keys {\n")
+			g.printf("e := %s[k]\n", x)
+			g.printf("w.MapKey(k)\n")
+			g.genWriteElem("e", t.Elem(), "StructEntry", "k")
+			g.printf("}\n} else {\n")
+			g.printf("for k, e := range %s {\n", x)
+			g.printf("w.MapKey(k)\n")
+			g.genWriteElem("e", t.Elem(), "StructEntry", "k")
+			g.printf("}\n}\nif err := w.End(); err != nil {\nreturn err\n}\n}\n")
+			g.needSort = true
+			return
+		}
+	}
+
+	g.printf("if err := w.Value(%s); err != nil {\nreturn err\n}\n", x)
+}
+
+// writeCall returns the Writer call writing x of the predeclared type or
+// []byte t, or ""
+func writeCall(x string, t types.Type) string {
+	switch k := basicKind(t); {
+	case k == types.String:
+		return "w.String(" + x + ")"
+	case k == types.Bool:
+		return "w.Bool(" + x + ")"
+	case isSigned(k):
+		return "w.Int(" + convert(x, t, types.Int64) + ")"
+	case isUnsigned(k):
+		return "w.Uint(" + convert(x, t, types.Uint64) + ")"
+	case k == types.Float32:
+		return "w.Float32(" + x + ")"
+	case k == types.Float64:
+		return "w.Float64(" + x + ")"
+	case isBytes(t):
+		return "w.Binary(" + x + ")"
+	}
+
+	return ""
+}
+
+// canWriteElem reports whether slice and map elements of type t are written
+// without falling back to Writer.Value
+func (g *generator) canWriteElem(t types.Type) bool {
+	return writeCall("", t) != "" || g.isGenerated(t)
+}
+
+// genWriteElem writes the slice or map element x, then flushes.  Generated
+// structs are written by the Writer method named, which is passed at for
+// error paths.
+func (g *generator) genWriteElem(x string, t types.Type, method string, at string) {
+	if call := writeCall(x, t); call != "" {
+		g.printf("%s\n", call)
+	} else {
+		g.printf("if err := w.%s(%s, &%s); err != nil {\nreturn err\n}\n", method, at, x)
+	}
+
+	g.printf("if err := w.Flush(); err != nil {\nreturn err\n}\n")
+}
+
+// isGenerated reports whether t is a struct type methods are generated for
+func (g *generator) isGenerated(t types.Type) bool {
+	named, ok := t.(*types.Named)
+	return ok && g.types[named.Obj()]
+}
+
+func (g *generator) genUnmarshal(tn *types.TypeName, fields []field) {
+	g.printf("// UnmarshalSereal implements sereal.Unmarshaler\n")
+	g.printf("func (v *%s) UnmarshalSereal(val sereal.Value) error {\n", tn.Name())
+	g.printf("return val.DecodeHash(v.unmarshalSerealField)\n")
+	g.printf("}\n\n")
+
+	g.printf("func (v *%s) unmarshalSerealField(key string, f sereal.Value) error {\n", tn.Name())
+	g.printf("switch key {\n")
+
+	for _, f := range fields {
+		g.printf("case %q:\n", f.name)
+		g.genReadField(f)
+	}
+
+	g.printf("default:\n")
+	g.printf("// like the decoder, fall back to the title-cased key\n")
+	g.printf("if t := strings.Title(key); t != key {\nreturn v.unmarshalSerealField(t, f)\n}\n")
+	g.printf("}\n\n")
+	g.printf("return nil\n}\n\n")
+}
+
+func (g *generator) genReadField(f field) {
+	x := "v." + f.goName
+
+	if f.asString {
+		g.printf("return f.DecodeStringOption(&%s)\n", x)
+		return
+	}
+
+	switch k := basicKind(f.typ); {
+	case k == types.String:
+		g.printf("return f.DecodeString(&%s)\n", x)
+	case k == types.Bool:
+		g.printf("return f.DecodeBool(&%s)\n", x)
+	case k == types.Int64:
+		g.printf("return f.DecodeInt(&%s)\n", x)
+	case k == types.Uint64:
+		g.printf("return f.DecodeUint(&%s)\n", x)
+	case k == types.Float64:
+		g.printf("return f.DecodeFloat(&%s)\n", x)
+	case isSigned(k):
+		g.genReadConverted(x, "int64", "DecodeInt", f.typ)
+	case isUnsigned(k):
+		g.genReadConverted(x, "uint64", "DecodeUint", f.typ)
+	case k == types.Float32:
+		g.genReadConverted(x, "float64", "DecodeFloat", f.typ)
+	case isBytes(f.typ):
+		g.printf("return f.DecodeBytes(&%s)\n", x)
+	default:
+		g.printf("return f.Decode(&%s)\n", x)
+	}
+}
+
+// genReadConverted reads a number of a smaller type than the Value method does
+func (g *generator) genReadConverted(x string, wide string, method string, t types.Type) {
+	g.printf("n := %s(%s)\n", wide, x)
+	g.printf("if err := f.%s(&n); err != nil {\nreturn err\n}\n", method)
+	g.printf("%s = %s(n)\n", x, t.String())
+	g.printf("return nil\n")
+}
@@ -9,7 +9,6 @@ import (
 	"reflect"
 	"runtime"
 	"strconv"
-	"strings"
 	"sync"
 )
 
@@ -22,6 +21,10 @@ type serealHeader struct {
 }
 
 func readHeader(b []byte) (serealHeader, error) {
+	if len(b) <= headerSize {
+		return serealHeader{}, ErrTruncated
+	}
+
 	first4Bytes := binary.LittleEndian.Uint32(b[:4])
 
 	var h serealHeader
@@ -48,21 +51,160 @@ func readHeader(b []byte) (serealHeader, error) {
 		return serealHeader{}, ErrBadHeader
 	}
 
-	ln, sz := varintdecode(b[5:])
+	ln, sz, err := readVarint(b[5:])
+	if err != nil {
+		return serealHeader{}, err
+	}
+	if ln < 0 || ln > len(b)-headerSize-sz {
+		return serealHeader{}, ErrTruncated
+	}
+
 	h.suffixSize = ln + sz
 	h.suffixStart = headerSize + sz
 
 	return h, nil
 }
 
-// A Decoder reads and decodes Sereal objects from an input buffer
+// documentLength returns the length of the Sereal document at the start of b,
+// or ErrTruncated if b doesn't hold all of it
+func documentLength(b []byte) (int, error) {
+	if len(b) <= headerSize {
+		return 0, ErrTruncated
+	}
+
+	ln, sz, err := readVarint(b[headerSize:])
+	if err != nil {
+		return 0, err
+	}
+
+	bodyStart := headerSize + sz + ln
+	if ln < 0 || bodyStart > len(b) {
+		return 0, ErrTruncated
+	}
+
+	header, err := readHeader(b)
+	if err != nil {
+		return 0, err
+	}
+
+	body := b[bodyStart:]
+
+	switch header.doctype {
+	case serealRaw:
+		ln, err = bodyLength(body)
+
+	case serealSnappy:
+		ln, err = snappyBlockLength(body)
+
+	case serealSnappyIncremental:
+		ln, sz, err = readVarint(body)
+		ln += sz
+
+	case serealZlib:
+		var usz, csz int
+		_, usz, err = readVarint(body)
+		if err == nil {
+			ln, csz, err = readVarint(body[usz:])
+			ln += usz + csz
+		}
+
+	default:
+		return 0, fmt.Errorf("document type '%d' not yet supported", header.doctype)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if ln < 0 || ln > len(body) {
+		return 0, ErrTruncated
+	}
+
+	return bodyStart + ln, nil
+}
+
+// A Decoder reads and decodes Sereal objects from an input buffer.  Once set
+// up, with its fields and the types and classes registered with it, it may be
+// used by several goroutines at once.
 type Decoder struct {
-	PerlCompat bool
-	copyDepth  int
+	PerlCompat       bool
+	StrictLongDouble bool // fail with ErrLongDoublePrecision rather than round LONG_DOUBLE values to float64
+
+	// Limits for documents from untrusted sources, as the Perl decoder has
+	// them.  Exceeding one fails with a *LimitError naming it, which
+	// errors.Is matches with ErrMaxStringLength and the like; 0 means no
+	// limit, but for MaxRecursionDepth, where it means
+	// DefaultMaxRecursionDepth so deep documents can't overflow the stack.
+	MaxRecursionDepth   int // nesting of references, arrays, hashes and objects
+	MaxNumHashEntries   int // entries of a single hash
+	MaxNumArrayEntries  int // elements of a single array
+	MaxStringLength     int // bytes of a single string
+	MaxUncompressedSize int // bytes of a compressed body once uncompressed
+	MaxDocumentSize     int // bytes of a single document read by a StreamDecoder
+
+	// Policies locking the decoder down to plain data, as the Perl decoder
+	// has them
+	RefuseObjects  bool // fail with ErrRefusedObject on objects, frozen ones included
+	NoBlessObjects bool // decode objects as what they're blessed, dropping the class
+	RefuseFreeze   bool // fail with ErrRefusedFreeze on frozen objects, so no UnmarshalBinary or thaw function is called
+	RefuseSnappy   bool // fail with ErrRefusedSnappy on snappy compressed documents
+	RefuseZlib     bool // fail with ErrRefusedZlib on zlib compressed documents
+
+	typeDecoders  map[reflect.Type]DecodeFunc
+	classDecoders map[string]DecodeFunc
+}
+
+// decodeState is what decoding a document keeps track of.  It isn't part of
+// the Decoder, so one Decoder can decode several documents at once.
+type decodeState struct {
+	tracked   map[int]reflect.Value
+	copyDepth int
+	depth     int // of references, arrays, hashes and objects being decoded
+	elements  int // array elements the rest of the document can hold
+
+	// the value the methods of Value went through last, so whoever handed
+	// it out needn't scan it for its length
+	lastIdx int
+	lastLen int
+}
+
+// newDecodeState starts decoding a document of size bytes, which valid
+// arrays can't claim more elements than between them
+func newDecodeState(size int) *decodeState {
+	return &decodeState{tracked: make(map[int]reflect.Value), elements: size}
+}
+
+// DefaultMaxRecursionDepth is the nesting a Decoder allows when its
+// MaxRecursionDepth isn't set, which is what the Perl decoder allows too
+const DefaultMaxRecursionDepth = 10000
+
+// A DecodeFunc builds a value from its encoded representation, for types which
+// can't implement Unmarshaler themselves
+type DecodeFunc func(v Value) (interface{}, error)
+
+// RegisterType makes the decoder call fn to decode values of type t.  The
+// result of fn must be assignable to t.
+func (d *Decoder) RegisterType(t reflect.Type, fn DecodeFunc) {
+	if d.typeDecoders == nil {
+		d.typeDecoders = make(map[reflect.Type]DecodeFunc)
+	}
+	d.typeDecoders[t] = fn
+}
+
+// RegisterObjectFunc makes the decoder call fn to decode Perl objects blessed
+// into class.  fn is passed the object's reference, and its result replaces
+// the object.
+func (d *Decoder) RegisterObjectFunc(class string, fn DecodeFunc) {
+	if d.classDecoders == nil {
+		d.classDecoders = make(map[string]DecodeFunc)
+	}
+	d.classDecoders[class] = fn
 }
 
 type decompressor interface {
-	decompress(b []byte) ([]byte, error)
+	// decompress fails with a *LimitError if b uncompresses to more than
+	// max bytes, unless max is 0
+	decompress(b []byte, max int) ([]byte, error)
 }
 
 // NewDecoder returns a decoder with default flags
@@ -86,6 +228,26 @@ func (d *Decoder) Unmarshal(b []byte, vbody interface{}) (err error) {
 	return d.UnmarshalHeaderBody(b, nil, vbody)
 }
 
+// UnmarshalAt parses the Sereal document starting at b[offset:] and extracts
+// the header and body data into vheader and vbody, respectively.  It returns
+// the number of bytes the document occupies, so the next document of a buffer
+// of concatenated documents starts at offset+consumed.  If the document can be
+// delimited but fails to decode, consumed is still set along with err.
+func (d *Decoder) UnmarshalAt(b []byte, offset int, vheader interface{}, vbody interface{}) (consumed int, err error) {
+	if offset < 0 || offset > len(b) {
+		return 0, ErrCorrupt{errBadOffset}
+	}
+
+	consumed, err = documentLength(b[offset:])
+	if err != nil {
+		return 0, err
+	}
+
+	// limit the capacity so decompression can't scribble over the next document
+	end := offset + consumed
+	return consumed, d.UnmarshalHeaderBody(b[offset:end:end], vheader, vbody)
+}
+
 // UnmarshalHeaderBody parses the Sereal-encoded buffer b extracts the header and body data into vheader and vbody, respectively
 func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody interface{}) (err error) {
 
@@ -132,15 +294,24 @@ func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody inter
 		if header.version != 1 {
 			return ErrBadSnappy
 		}
+		if d.RefuseSnappy {
+			return ErrRefusedSnappy
+		}
 		decomp = SnappyCompressor{Incremental: false}
 
 	case serealSnappyIncremental:
+		if d.RefuseSnappy {
+			return ErrRefusedSnappy
+		}
 		decomp = SnappyCompressor{Incremental: true}
 
 	case serealZlib:
 		if header.version < 3 {
 			return ErrBadZlibV3
 		}
+		if d.RefuseZlib {
+			return ErrRefusedZlib
+		}
 		decomp = ZlibCompressor{}
 
 	default:
@@ -150,7 +321,7 @@ func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody inter
 	/* XXX instead of creating an uncompressed copy of the document,
 	 *     it would be more flexible to use a sort of "Reader" interface */
 	if decomp != nil {
-		decompBody, err := decomp.decompress(b[bodyStart:])
+		decompBody, err := decomp.decompress(b[bodyStart:], d.MaxUncompressedSize)
 		if err != nil {
 			return err
 		}
@@ -161,8 +332,8 @@ func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody inter
 		b = append(b, decompBody...)
 	}
 
-	if vheader != nil && header.suffixSize != 1 {
-		tracked := make(map[int]reflect.Value)
+	if vheader != nil && bodyStart > header.suffixStart {
+		st := newDecodeState(bodyStart - header.suffixStart)
 		if reflect.TypeOf(vheader).Kind() != reflect.Ptr {
 			return ErrHeaderPointer
 		}
@@ -172,7 +343,7 @@ func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody inter
 		header.suffixFlags = b[header.suffixStart]
 
 		if header.suffixFlags&1 == 1 {
-			_, err = d.decode(b[header.suffixStart+1:bodyStart], 0, tracked, headerPtrValue.Elem())
+			_, err = d.decode(b[header.suffixStart+1:bodyStart], 0, st, headerPtrValue.Elem())
 
 			if err != nil {
 				return err
@@ -182,7 +353,7 @@ func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody inter
 	}
 
 	if err == nil && vbody != nil {
-		tracked := make(map[int]reflect.Value)
+		st := newDecodeState(len(b) - bodyStart)
 
 		if reflect.TypeOf(vbody).Kind() != reflect.Ptr {
 			return ErrBodyPointer
@@ -190,11 +361,17 @@ func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody inter
 
 		bodyPtrValue := reflect.ValueOf(vbody)
 
+		base := bodyStart
 		if header.version == 1 {
-			_, err = d.decode(b, bodyStart, tracked, bodyPtrValue.Elem())
+			_, err = d.decode(b, bodyStart, st, bodyPtrValue.Elem())
 		} else {
 			//  serealv2 documents have 1-based offsets :/
-			_, err = d.decode(b[bodyStart-1:], 1, tracked, bodyPtrValue.Elem())
+			base = 1
+			_, err = d.decode(b[bodyStart-1:], 1, st, bodyPtrValue.Elem())
+		}
+
+		if de, ok := err.(*DecodeError); ok {
+			de.Offset -= base
 		}
 
 		if err != nil {
@@ -205,7 +382,41 @@ func (d *Decoder) UnmarshalHeaderBody(b []byte, vheader interface{}, vbody inter
 	return nil
 }
 
-func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr reflect.Value) (int, error) {
+// decode decodes the value at b[idx:] into ptr and returns its size
+func (d *Decoder) decode(b []byte, idx int, st *decodeState, ptr reflect.Value) (int, error) {
+	return d.decodePlanned(b, idx, st, ptr, nil)
+}
+
+// decodePlanned is decode with the plan of ptr's type, if known already
+func (d *Decoder) decodePlanned(b []byte, idx int, st *decodeState, ptr reflect.Value, plan *decodePlan) (int, error) {
+	sz, err := d.decodeValue(b, idx, st, ptr, plan)
+	if err != nil {
+		return 0, newDecodeError(err, b, idx, ptr)
+	}
+
+	return sz, nil
+}
+
+// newDecodeError wraps err, returned for the value at b[idx:] decoded into
+// ptr, in a *DecodeError, unless a value nested in it did so already or err
+// isn't about the document
+func newDecodeError(err error, b []byte, idx int, ptr reflect.Value) error {
+	if _, ok := err.(ErrCorrupt); !ok && err != ErrUnknownTag && err != ErrTypeMismatch {
+		return err
+	}
+
+	e := &DecodeError{Offset: idx, Err: err}
+	if idx >= 0 && idx < len(b) {
+		e.Tag = b[idx] &^ trackFlag
+	}
+	if ptr.IsValid() {
+		e.Type = ptr.Type()
+	}
+
+	return e
+}
+
+func (d *Decoder) decodeValue(b []byte, idx int, st *decodeState, ptr reflect.Value, plan *decodePlan) (int, error) {
 
 	if idx < 0 || idx >= len(b) {
 		return 0, ErrTruncated
@@ -230,6 +441,62 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 
 	tag &^= trackFlag
 
+	// counted before the value is handed to an Unmarshaler, which may decode
+	// nested values itself
+	if isNested(tag) {
+		st.depth++
+		defer func() { st.depth-- }()
+
+		max := d.MaxRecursionDepth
+		if max == 0 {
+			max = DefaultMaxRecursionDepth
+		}
+
+		if err := checkLimit(ErrMaxRecursionDepth, max, st.depth); err != nil {
+			return 0, err
+		}
+	}
+
+	// like a nil pointer encodes to undef, undef decodes to a nil pointer
+	isNilPtr := ptr.Kind() == reflect.Ptr && (tag == typeUNDEF || tag == typeCANONICAL_UNDEF)
+
+	if !isNilPtr && !isShared(b, idx, tag, st.tracked, ptr) {
+		if fn, ok := d.typeDecoders[ptr.Type()]; ok {
+			return d.decodeViaFunc(b, startIdx, trackme, st, ptr, fn)
+		}
+
+		// nothing decodes into an interface by itself
+		if ptr.Kind() == reflect.Interface {
+			plan = noPlan
+		} else if plan == nil {
+			plan = planFor(ptr.Type())
+		}
+
+		if u, ok := findSerealUnmarshaler(ptr, plan); ok {
+			return d.decodeViaUnmarshaler(b, startIdx, trackme, st, ptr, u)
+		}
+
+		if plan.textUnmarshaler != (implementation{}) && isStringish(b, startIdx) {
+			if u, ok := findTextUnmarshaler(ptr, plan); ok {
+				var text []byte
+				sz, err := d.decode(b, startIdx, st, reflect.ValueOf(&text).Elem())
+				if err != nil {
+					return 0, err
+				}
+
+				if err := u.UnmarshalText(text); err != nil {
+					return 0, err
+				}
+
+				if trackme {
+					st.tracked[startIdx] = ptr
+				}
+
+				return sz, nil
+			}
+		}
+	}
+
 	switch {
 	case tag < typeVARINT:
 		idx++
@@ -238,23 +505,32 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 		if neg {
 			i -= 32
 		}
-		setInt(ptr, reflect.Int, i)
+		if err := setInt(ptr, reflect.Int, i); err != nil {
+			return 0, err
+		}
 
 	case tag == typeVARINT, tag == typeZIGZAG:
 		idx++
-		i, sz := varintdecode(b[idx:])
+		i, sz, err := readVarint(b[idx:])
+		if err != nil {
+			return 0, err
+		}
 		idx += sz
 		if tag == typeVARINT {
 			// varints are unsigned, but we returned a signed int if possible
 			if i < 0 {
-				setInt(ptr, reflect.Uint, i)
+				err = setInt(ptr, reflect.Uint, i)
 			} else {
-				setInt(ptr, reflect.Int, i)
+				err = setInt(ptr, reflect.Int, i)
 			}
 		} else {
 			// zigzag
 			i = int(-(1 + (uint64(i) >> 1))) // un-zigzag
-			setInt(ptr, reflect.Int, i)
+			err = setInt(ptr, reflect.Int, i)
+		}
+
+		if err != nil {
+			return 0, err
 		}
 
 	case tag == typeFLOAT:
@@ -267,7 +543,9 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 		bits := uint32(b[idx]) | uint32(b[idx+1])<<8 | uint32(b[idx+2])<<16 | uint32(b[idx+3])<<24
 		f := math.Float32frombits(bits)
 		idx += 4
-		setFloat(ptr, reflect.Float32, float64(f))
+		if err := setFloat(ptr, reflect.Float32, float64(f)); err != nil {
+			return 0, err
+		}
 
 	case tag == typeDOUBLE:
 		idx++
@@ -279,7 +557,21 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 		bits := uint64(b[idx]) | uint64(b[idx+1])<<8 | uint64(b[idx+2])<<16 | uint64(b[idx+3])<<24 | uint64(b[idx+4])<<32 | uint64(b[idx+5])<<40 | uint64(b[idx+6])<<48 | uint64(b[idx+7])<<56
 		f := math.Float64frombits(bits)
 		idx += 8
-		setFloat(ptr, reflect.Float64, float64(f))
+		if err := setFloat(ptr, reflect.Float64, float64(f)); err != nil {
+			return 0, err
+		}
+
+	case tag == typeLONG_DOUBLE:
+		idx++
+
+		if idx+15 >= len(b) {
+			return 0, ErrTruncated
+		}
+
+		if err := setLongDouble(ptr, b[idx:idx+16], d.StrictLongDouble); err != nil {
+			return 0, err
+		}
+		idx += 16
 
 	case tag == typeUNDEF, tag == typeCANONICAL_UNDEF:
 		idx++
@@ -300,14 +592,25 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 	case tag == typeBINARY:
 
 		idx++
-		ln, sz := varintdecode(b[idx:])
+		ln, sz, err := readVarint(b[idx:])
+		if err != nil {
+			return 0, err
+		}
 
 		if ln < 0 || ln > math.MaxInt32 {
 			return 0, ErrCorrupt{errBadSliceSize}
 		}
 
+		if err := checkLimit(ErrMaxStringLength, d.MaxStringLength, ln); err != nil {
+			return 0, err
+		}
+
 		idx += sz
 
+		if idx+ln > len(b) {
+			return 0, ErrTruncated
+		}
+
 		var slice reflect.Value
 
 		switch {
@@ -326,23 +629,28 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 			slice = ptr
 		}
 
-		if idx+ln > len(b) {
-			return 0, ErrTruncated
+		if err := setString(slice, b[idx:idx+ln]); err != nil {
+			return 0, err
 		}
-
-		setString(slice, b[idx:idx+ln])
 		idx += ln
 
 	case tag == typeSTR_UTF8:
 
 		idx++
-		ln, sz := varintdecode(b[idx:])
+		ln, sz, err := readVarint(b[idx:])
+		if err != nil {
+			return 0, err
+		}
 		idx += sz
 
 		if ln < 0 {
 			return 0, ErrCorrupt{errBadStringSize}
 		}
 
+		if err := checkLimit(ErrMaxStringLength, d.MaxStringLength, ln); err != nil {
+			return 0, err
+		}
+
 		if idx+ln > len(b) {
 			return 0, ErrTruncated
 		}
@@ -357,12 +665,16 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 			ptr.Set(p)
 		case ptr.Kind() == reflect.String:
 			ptr.SetString(s)
+		case ptr.Kind() == reflect.Slice && ptr.Type().Elem().Kind() == reflect.Uint8:
+			ptr.SetBytes([]byte(s))
 		default:
-			panic("bad type for string: " + ptr.Kind().String())
+			return 0, ErrTypeMismatch
 		}
 
-		if trackme {
-			tracked[startIdx] = p
+		// in PerlCompat mode strings are tracked where they're stored, so
+		// aliases can share them
+		if trackme && !d.PerlCompat {
+			st.tracked[startIdx] = p
 		}
 
 	case tag == typeREFN:
@@ -379,10 +691,14 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 				// so, create a pointer to 'something' and store it for later
 				p = reflect.New(re.Elem().Type())
 				p.Elem().Set(re)
-				tracked[startIdx] = p
+				st.tracked[startIdx] = p
 			}
 
-			sz, _ := d.decode(b, idx, tracked, re.Elem())
+			referentIdx := idx
+			sz, err := d.decode(b, idx, st, re.Elem())
+			if err != nil {
+				return 0, err
+			}
 			idx += sz
 
 			// replace p with a more accurate pointer type
@@ -392,30 +708,79 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 			p.Elem().Set(re.Elem().Elem())
 			ptr.Set(p)
 			if trackme {
-				tracked[startIdx] = p
+				st.tracked[startIdx] = p
+			}
+
+			// later references to the thing referenced share p
+			if _, ok := st.tracked[referentIdx]; ok {
+				st.tracked[referentIdx] = p.Elem()
 			}
 		} else {
-			// references are flattened, same as gob
-			sz, _ := d.decode(b, idx, tracked, ptr)
+			// references are flattened, same as gob, unless decoding
+			// into a pointer
+			target := ptr
+			if ptr.Kind() == reflect.Ptr {
+				if ptr.IsNil() {
+					ptr.Set(reflect.New(ptr.Type().Elem()))
+				}
+				target = ptr.Elem()
+			}
+
+			if trackme {
+				// for cycles back to this reference
+				st.tracked[startIdx] = target
+			}
+
+			sz, err := d.decode(b, idx, st, target)
+			if err != nil {
+				return 0, err
+			}
 			idx += sz
 		}
 
 	case tag == typeREFP:
 		idx++
 
-		offs, sz := varintdecode(b[idx:])
+		offs, sz, err := readVarint(b[idx:])
+		if err != nil {
+			return 0, err
+		}
 		idx += sz
 
 		if offs < 0 || offs > len(b) {
 			return 0, ErrCorrupt{errBadOffset}
 		}
 
-		e, ok := tracked[offs]
+		e, ok := st.tracked[offs]
 
 		if !ok {
 			return 0, ErrCorrupt{errUntrackedOffsetREFP}
 		}
 
+		// pointers to Go values point to the decoded value itself
+		if ptr.Kind() == reflect.Ptr && e.CanAddr() && e.Addr().Type() == ptr.Type() {
+			ptr.Set(e.Addr())
+			break
+		}
+
+		// as do references to the thing referenced by an earlier REFN
+		if d.PerlCompat && isReferent(st.tracked, offs, e) && e.Addr().Type().AssignableTo(ptr.Type()) {
+			ptr.Set(e.Addr())
+			break
+		}
+
+		// Perl refers to a frozen object again via its values, see
+		// OBJECT_FREEZE
+		if _, ok := e.Interface().(*PerlFreeze); ok && d.PerlCompat && ptr.Kind() == reflect.Interface {
+			ptr.Set(e)
+			break
+		}
+
+		// point to what's tracked, rather than to the interface holding it
+		if e.Kind() == reflect.Interface && !e.IsNil() {
+			e = e.Elem()
+		}
+
 		p := reflect.New(e.Type())
 		p.Elem().Set(e)
 		ptr.Set(p)
@@ -424,13 +789,20 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 
 		idx++
 
-		ln, sz := varintdecode(b[idx:])
+		ln, sz, err := readVarint(b[idx:])
+		if err != nil {
+			return 0, err
+		}
 		idx += sz
 
 		if ln < 0 || ln > math.MaxInt32 {
 			return 0, ErrCorrupt{errBadHashSize}
 		}
 
+		if err := checkLimit(ErrMaxNumHashEntries, d.MaxNumHashEntries, ln); err != nil {
+			return 0, err
+		}
+
 		if 2*ln > len(b[idx:]) {
 			// not enough sereal tags remaining
 			return 0, ErrTruncated
@@ -441,45 +813,43 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 			ptr.Set(reflect.ValueOf(m))
 		}
 
-		tags := getStructTags(ptr)
-
 		if trackme {
-			tracked[startIdx] = ptr
+			st.tracked[startIdx] = ptr
 		}
 
-		for i := 0; i < ln; i++ {
-			var key string
-			rkey := reflect.ValueOf(&key)
-			sz, err := d.decode(b, idx, tracked, rkey.Elem())
-			if err != nil {
-				return 0, err
-			}
-
-			idx += sz
-			rval, _ := getValue(ptr, key, tags)
-			sz, err = d.decode(b, idx, tracked, rval)
-			if err != nil {
-				return 0, err
-			}
-			idx += sz
-			setKeyValue(ptr, key, rval, tags)
+		if idx, err = d.decodeEntries(b, idx, ln, st, ptr, ptr); err != nil {
+			return 0, err
 		}
 
 	case tag == typeARRAY:
 
 		idx++
-		ln, sz := varintdecode(b[idx:])
+		ln, sz, err := readVarint(b[idx:])
+		if err != nil {
+			return 0, err
+		}
 		idx += sz
 
 		if ln < 0 || ln > math.MaxInt32 {
 			return 0, ErrCorrupt{errBadSliceSize}
 		}
 
+		if err := checkLimit(ErrMaxNumArrayEntries, d.MaxNumArrayEntries, ln); err != nil {
+			return 0, err
+		}
+
 		if ln > len(b[idx:]) {
 			// not enough sereal tags remaining
 			return 0, ErrTruncated
 		}
 
+		// copies decode again what was accounted for already
+		if st.copyDepth == 0 {
+			if st.elements -= ln; st.elements < 0 {
+				return 0, ErrTruncated
+			}
+		}
+
 		var slice reflect.Value
 
 		switch {
@@ -501,11 +871,11 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 		case (ptr.Kind() == reflect.Slice && ptr.Len() > 0) || ptr.Kind() == reflect.Array:
 			slice = ptr
 		default:
-			panic("unhandled type: " + ptr.Kind().String())
+			return 0, ErrTypeMismatch
 		}
 
 		if trackme {
-			tracked[startIdx] = ptr
+			st.tracked[startIdx] = ptr
 		}
 
 		for i := 0; i < ln; i++ {
@@ -516,56 +886,52 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 				var iface interface{}
 				e = reflect.ValueOf(&iface).Elem()
 			}
-			sz, err := d.decode(b, idx, tracked, e)
+			sz, err := d.decode(b, idx, st, e)
 			if err != nil {
-				return 0, err
+				return 0, prependPath(err, "["+strconv.Itoa(i)+"]")
 			}
 
 			idx += sz
 		}
 
 	case tag == typeOBJECT:
+		if d.RefuseObjects {
+			return 0, ErrRefusedObject
+		}
 		idx++
 
-		// FIXME: track before recurse?
+		if trackme {
+			// for cycles back to the object
+			st.tracked[startIdx] = ptr
+		}
+
 		var s string
 		className := reflect.ValueOf(&s)
 		if !isStringish(b, idx) {
 			return 0, ErrCorrupt{errStringish}
 		}
-		sz, err := d.decode(b, idx, tracked, className.Elem())
+		sz, err := d.decode(b, idx, st, className.Elem())
 		if err != nil {
 			return 0, err
 		}
 		idx += sz
 
-		if d.PerlCompat {
-			var ref interface{}
-			rref := reflect.ValueOf(&ref)
-			sz, err := d.decode(b, idx, tracked, rref.Elem())
-			if err != nil {
-				return 0, err
-			}
-			idx += sz
-
-			s := stringOf(className)
-			o := &PerlObject{s, ref}
-			ptr.Set(reflect.ValueOf(o))
-		} else {
-			sz, err := d.decode(b, idx, tracked, ptr)
-			if err != nil {
-				return 0, err
-			}
-
-			idx += sz
-
-			// FIXME: stuff className somewhere if map/struct?
+		sz, err = d.decodeObject(b, idx, st, ptr, s)
+		if err != nil {
+			return 0, err
 		}
+		idx += sz
 
 	case tag == typeOBJECTV:
+		if d.RefuseObjects {
+			return 0, ErrRefusedObject
+		}
 		idx++
-		offs, sz := varintdecode(b[idx:])
-		if offs >= len(b) {
+		offs, sz, err := readVarint(b[idx:])
+		if err != nil {
+			return 0, err
+		}
+		if offs < 0 || offs >= startIdx {
 			return 0, ErrCorrupt{errBadOffset}
 		}
 		idx += sz
@@ -574,39 +940,31 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 		if !isStringish(b, offs) {
 			return 0, ErrCorrupt{errStringish}
 		}
-		sz, err := d.decode(b, offs, tracked, className.Elem())
-		if err != nil {
+		if _, err := d.decode(b, offs, st, className.Elem()); err != nil {
 			return 0, err
 		}
 
-		if d.PerlCompat {
-			var ref interface{}
-			rref := reflect.ValueOf(&ref)
-			sz, err := d.decode(b, idx, tracked, rref.Elem())
-			if err != nil {
-				return 0, err
-			}
-			idx += sz
+		if trackme {
+			st.tracked[startIdx] = ptr
+		}
 
-			s := stringOf(className)
-			o := &PerlObject{s, ref}
-			ptr.Set(reflect.ValueOf(o))
-		} else {
-			sz, err := d.decode(b, idx, tracked, ptr)
-			if err != nil {
-				return 0, err
-			}
-			idx += sz
+		sz, err = d.decodeObject(b, idx, st, ptr, s)
+		if err != nil {
+			return 0, err
 		}
+		idx += sz
 
 	case tag == typeTRUE, tag == typeFALSE:
 		idx++
 		bol := tag == typeTRUE
 
-		if ptr.Kind() == reflect.Interface && ptr.IsNil() {
+		switch {
+		case ptr.Kind() == reflect.Interface && ptr.IsNil():
 			ptr.Set(reflect.ValueOf(bol))
-		} else {
+		case ptr.Kind() == reflect.Bool:
 			ptr.SetBool(bol)
+		default:
+			return 0, ErrTypeMismatch
 		}
 
 	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
@@ -614,6 +972,10 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 		idx++
 		ln := int(tag & 0x0f)
 
+		if err := checkLimit(ErrMaxNumArrayEntries, d.MaxNumArrayEntries, ln); err != nil {
+			return 0, err
+		}
+
 		var slice reflect.Value
 
 		switch {
@@ -635,7 +997,7 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 				ptr.Set(slice)
 			}
 
-		case ptr.Kind() == reflect.Slice && ptr.IsNil():
+		case ptr.Kind() == reflect.Slice && (ptr.IsNil() || ptr.Len() == 0):
 			slice = reflect.MakeSlice(ptr.Type(), ln, ln)
 			ptr.Set(slice)
 
@@ -643,11 +1005,11 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 			slice = ptr
 
 		default:
-			panic("unhandled type: " + ptr.Kind().String())
+			return 0, ErrTypeMismatch
 		}
 
 		if trackme {
-			tracked[startIdx] = ptr
+			st.tracked[startIdx] = ptr
 		}
 
 		for i := 0; i < ln; i++ {
@@ -658,9 +1020,9 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 				var iface interface{}
 				e = reflect.ValueOf(&iface).Elem()
 			}
-			sz, err := d.decode(b, idx, tracked, e)
+			sz, err := d.decode(b, idx, st, e)
 			if err != nil {
-				return 0, err
+				return 0, prependPath(err, "["+strconv.Itoa(i)+"]")
 			}
 			idx += sz
 		}
@@ -670,6 +1032,10 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 		idx++
 		ln := int(tag & 0x0f)
 
+		if err := checkLimit(ErrMaxNumHashEntries, d.MaxNumHashEntries, ln); err != nil {
+			return 0, err
+		}
+
 		// FIXME:
 		// 1) this is now identical to the typeHASH case
 		// 2) how does this affect PerlCompat mode?
@@ -694,32 +1060,22 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 		}
 
 		if trackme {
-			tracked[startIdx] = ptr
+			st.tracked[startIdx] = ptr
 		}
 
-		structTags := getStructTags(ptr)
-
-		for i := 0; i < ln; i++ {
-			var key string
-			rkey := reflect.ValueOf(&key)
-			sz, err := d.decode(b, idx, tracked, rkey.Elem())
-			if err != nil {
-				return 0, err
-			}
-			idx += sz
-			rval, _ := getValue(ptr, key, structTags)
-			sz, err = d.decode(b, idx, tracked, rval)
-			if err != nil {
-				return 0, err
-			}
-			idx += sz
-			setKeyValue(href, key, rval, structTags)
+		var err error
+		if idx, err = d.decodeEntries(b, idx, ln, st, ptr, href); err != nil {
+			return 0, err
 		}
 
 	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
 		ln := int(tag & 0x1F) // get length from tag
 		idx++
 
+		if err := checkLimit(ErrMaxStringLength, d.MaxStringLength, ln); err != nil {
+			return 0, err
+		}
+
 		// identical to BINARY
 		// very similar to ARRAY
 		var slice reflect.Value
@@ -744,48 +1100,73 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 			return 0, ErrTruncated
 		}
 
-		setString(slice, b[idx:idx+ln])
+		if err := setString(slice, b[idx:idx+ln]); err != nil {
+			return 0, err
+		}
 		idx += ln
 
 	case tag == typeALIAS:
 		idx++
 
-		offs, sz := varintdecode(b[idx:])
+		offs, sz, err := readVarint(b[idx:])
+		if err != nil {
+			return 0, err
+		}
 		idx += sz
 
 		if offs < 0 || offs >= len(b) {
 			return 0, ErrCorrupt{errBadOffset}
 		}
 
-		e, ok := tracked[offs]
+		e, ok := st.tracked[offs]
 		if !ok {
 			return 0, ErrCorrupt{errUntrackedOffsetAlias}
 		}
 
+		// references share what they refer to already, but other values
+		// can't be shared, so both the value aliased and the alias become
+		// the same *PerlAlias
+		if d.PerlCompat && e.Kind() == reflect.Interface && e.CanSet() && ptr.Kind() == reflect.Interface && !isReference(e.Elem()) {
+			a, ok := e.Interface().(*PerlAlias)
+			if !ok {
+				a = &PerlAlias{e.Interface()}
+				e.Set(reflect.ValueOf(a))
+			}
+			ptr.Set(reflect.ValueOf(a))
+			break
+		}
+
 		// FIXME: not technically correct, but better than nothing
 		// also, better than panicking
 
+		if e.Kind() == reflect.Interface && !e.IsNil() && !e.Type().AssignableTo(ptr.Type()) {
+			e = e.Elem()
+		}
+
 		ptr.Set(e)
 
 	case tag == typeCOPY:
 		idx++
 
-		// FIXME: copyDepth isn't reset properly on decoder start -- move it somewhere else?
-		d.copyDepth++
-		defer func() { d.copyDepth-- }()
+		st.copyDepth++
+		defer func() { st.copyDepth-- }()
 
-		offs, sz := varintdecode(b[idx:])
+		offs, sz, err := readVarint(b[idx:])
+		if err != nil {
+			return 0, err
+		}
 		idx += sz
 
-		if offs < 0 || offs >= len(b) {
+		// offsets refer back to values seen already
+		if offs < 0 || offs >= startIdx {
 			return 0, ErrCorrupt{errBadOffset}
 		}
 
-		if d.copyDepth > 0 && !isStringish(b, offs) {
+		if st.copyDepth > 0 && !isStringish(b, offs) {
 			return 0, ErrCorrupt{errNestedCOPY}
 		}
 
-		sz, err := d.decode(b, offs, tracked, ptr)
+		sz, err = d.decode(b, offs, st, ptr)
 		if err != nil {
 			return 0, err
 		}
@@ -796,9 +1177,14 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 		var r interface{}
 		rr := reflect.ValueOf(&r).Elem()
 
-		// FIXME: track before recurse?, as with REFN?
+		if trackme {
+			st.tracked[startIdx] = ptr
+		}
 
-		sz, _ := d.decode(b, idx, tracked, rr)
+		sz, err := d.decode(b, idx, st, rr)
+		if err != nil {
+			return 0, err
+		}
 		idx += sz
 		if d.PerlCompat {
 			w := PerlWeakRef{r}
@@ -809,54 +1195,121 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 
 	case tag == typeREGEXP:
 		idx++
-		// FIXME: track before recurse?
-		var pat string
-		rpat := reflect.ValueOf(&pat)
-		sz, _ := d.decode(b, idx, tracked, rpat.Elem())
-		idx += sz
-		var mod []byte
-		rmod := reflect.ValueOf(&mod)
-		sz, _ = d.decode(b, idx, tracked, rmod.Elem())
-		idx += sz
-
-		re := &PerlRegexp{[]byte(pat), mod}
 
+		re := &PerlRegexp{}
 		rre := reflect.ValueOf(re)
 
 		if trackme {
-			tracked[startIdx] = rre
+			st.tracked[startIdx] = rre
 		}
 
+		var pat string
+		rpat := reflect.ValueOf(&pat)
+		sz, err := d.decode(b, idx, st, rpat.Elem())
+		if err != nil {
+			return 0, err
+		}
+		idx += sz
+		rmod := reflect.ValueOf(&re.Modifiers)
+		sz, err = d.decode(b, idx, st, rmod.Elem())
+		if err != nil {
+			return 0, err
+		}
+		idx += sz
+
+		re.Pattern = []byte(pat)
+
 		ptr.Set(rre)
 
-	case tag == typeOBJECT_FREEZE:
+	case tag == typeOBJECT_FREEZE, tag == typeOBJECTV_FREEZE:
+		if d.RefuseObjects {
+			return 0, ErrRefusedObject
+		}
+		if d.RefuseFreeze {
+			return 0, ErrRefusedFreeze
+		}
 		idx++
 
 		var class string
 		rclass := reflect.ValueOf(&class)
-		sz, err := d.decode(b, idx, tracked, rclass.Elem())
+
+		if tag == typeOBJECT_FREEZE {
+			sz, err := d.decode(b, idx, st, rclass.Elem())
+			if err != nil {
+				return 0, err
+			}
+			idx += sz
+		} else {
+			offs, sz, err := readVarint(b[idx:])
+			if err != nil {
+				return 0, err
+			}
+			if offs < 0 || offs >= startIdx {
+				return 0, ErrCorrupt{errBadOffset}
+			}
+			idx += sz
+
+			if !isStringish(b, offs) {
+				return 0, ErrCorrupt{errStringish}
+			}
+
+			if _, err := d.decode(b, offs, st, rclass.Elem()); err != nil {
+				return 0, err
+			}
+		}
+
+		// without a class, the object is just its values
+		if d.NoBlessObjects {
+			sz, err := d.decode(b, idx, st, ptr)
+			if err != nil {
+				return 0, err
+			}
+			idx += sz
+			break
+		}
+
+		// the values returned by FREEZE, in an array reference
+		var payload interface{}
+		rpayload := reflect.ValueOf(&payload)
+		payloadIdx := idx
+		sz, err := d.decode(b, idx, st, rpayload.Elem())
 		if err != nil {
 			return 0, err
 		}
 		idx += sz
 
-		// spec says 'any object', but we only support byte slices
-		var data []byte
-		rdata := reflect.ValueOf(&data)
-		sz, err = d.decode(b, idx, tracked, rdata.Elem())
+		values, data, err := freezeValues(payload)
 		if err != nil {
 			return 0, err
 		}
-		idx += sz
+
+		registerLock.Lock()
+		thaw, thawOk := thawFuncs[class]
+		registerLock.Unlock()
 
 		var rfreeze reflect.Value
 
-		if d.PerlCompat {
-			freeze := &PerlFreeze{class, data}
+		if thawOk && ptr.Kind() == reflect.Interface {
+			obj, err := thaw(values)
+			if err != nil {
+				return 0, err
+			}
+
+			rfreeze = reflect.ValueOf(obj)
+			if !rfreeze.IsValid() {
+				rfreeze = reflect.Zero(ptr.Type())
+			}
+		} else if d.PerlCompat {
+			freeze := &PerlFreeze{class, data, values}
 			rfreeze = reflect.ValueOf(freeze)
 		} else {
 
 			if obj, ok := findUnmarshaler(ptr); ok {
+				if data == nil {
+					// FREEZE returned values rather than a single string
+					return 0, ErrTypeMismatch
+				}
+
 				err := obj.UnmarshalBinary(data)
 				if err != nil {
 					return 0, err
@@ -873,13 +1326,13 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 					concreteClass, ok := nameToType[class]
 					registerLock.Unlock()
 
-					if ok {
+					if ok && data != nil {
 						rzero := instantiateZero(concreteClass)
 						obj, ok := findUnmarshaler(rzero)
 
 						if !ok {
 							// only things that have an unmarshaler should have been put into the map
-							panic(fmt.Sprintf("unable to find unmarshaler for %s", rzero))
+							return 0, ErrTypeMismatch
 						}
 
 						err := obj.UnmarshalBinary(data)
@@ -889,37 +1342,202 @@ func (d *Decoder) decode(b []byte, idx int, tracked map[int]reflect.Value, ptr r
 
 						rfreeze = reflect.ValueOf(obj)
 					} else {
-						rfreeze = reflect.ValueOf(&PerlFreeze{class, data})
+						rfreeze = reflect.ValueOf(&PerlFreeze{class, data, values})
 					}
 
-				case ptr.Kind() == reflect.Slice && ptr.Type().Elem().Kind() == reflect.Uint8 && ptr.IsNil():
+				case ptr.Kind() == reflect.Slice && ptr.Type().Elem().Kind() == reflect.Uint8 && ptr.IsNil() && data != nil:
 					rfreeze = reflect.ValueOf(data)
 
 				default:
-					return 0, fmt.Errorf("can't unpack FROZEN object into %v", ptr.Type())
+					return 0, ErrTypeMismatch
 				}
 			}
 		}
 
 		if trackme {
-			tracked[startIdx] = rfreeze
+			st.tracked[startIdx] = rfreeze
+		}
+
+		// like perl, make later references to the array of values point to
+		// the thawed object instead
+		if b[payloadIdx]&^trackFlag == typeREFN && payloadIdx+1 < len(b) && b[payloadIdx+1]&trackFlag == trackFlag {
+			st.tracked[payloadIdx+1] = rfreeze
 		}
 
 		ptr.Set(rfreeze)
 
 	default:
-		return 0, errors.New("unknown tag byte: " + strconv.Itoa(int(tag)))
+		return 0, ErrUnknownTag
 	}
 
-	if _, ok := tracked[startIdx]; !ok && trackme {
-		tracked[startIdx] = ptr
+	if _, ok := st.tracked[startIdx]; !ok && trackme {
+		st.tracked[startIdx] = ptr
 	}
 
 	return idx - startIdx, nil
 
 }
 
-func setInt(v reflect.Value, k reflect.Kind, i int) {
+// decodeObject decodes the reference of an object blessed into class
+func (d *Decoder) decodeObject(b []byte, idx int, st *decodeState, ptr reflect.Value, class string) (int, error) {
+	if d.NoBlessObjects {
+		return d.decode(b, idx, st, ptr)
+	}
+
+	if fn, ok := d.classDecoders[class]; ok {
+		return d.decodeViaFunc(b, idx, false, st, ptr, fn)
+	}
+
+	if t, ok := classType(class); ok && !d.PerlCompat && ptr.Kind() == reflect.Interface && t.AssignableTo(ptr.Type()) {
+		obj := reflect.New(classKey(t))
+		sz, err := d.decode(b, idx, st, obj.Elem())
+		if err != nil {
+			return 0, err
+		}
+
+		if t.Kind() == reflect.Ptr {
+			ptr.Set(obj)
+		} else {
+			ptr.Set(obj.Elem())
+		}
+		return sz, nil
+	}
+
+	if d.PerlCompat {
+		// set before decoding the reference, which may refer back to o
+		o := &PerlObject{Class: class}
+		ptr.Set(reflect.ValueOf(o))
+
+		return d.decode(b, idx, st, reflect.ValueOf(&o.Reference).Elem())
+	}
+
+	// FIXME: stuff className somewhere if map/struct?
+	return d.decode(b, idx, st, ptr)
+}
+
+// decodeViaFunc sets ptr to the result of fn for the value at idx
+func (d *Decoder) decodeViaFunc(b []byte, idx int, trackme bool, st *decodeState, ptr reflect.Value, fn DecodeFunc) (int, error) {
+	v, err := fn(Value{d: d, b: b, idx: idx, st: st})
+	if err != nil {
+		return 0, err
+	}
+
+	sz, err := st.valueLength(b, idx)
+	if err != nil {
+		return 0, err
+	}
+
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		rv = reflect.Zero(ptr.Type())
+	}
+
+	if !rv.Type().AssignableTo(ptr.Type()) {
+		return 0, fmt.Errorf("can't assign decoded %v to %v", rv.Type(), ptr.Type())
+	}
+
+	ptr.Set(rv)
+
+	if trackme {
+		st.tracked[idx] = ptr
+	}
+
+	return sz, nil
+}
+
+// decodeViaUnmarshaler hands the value at idx over to u's UnmarshalSereal
+func (d *Decoder) decodeViaUnmarshaler(b []byte, idx int, trackme bool, st *decodeState, ptr reflect.Value, u Unmarshaler) (int, error) {
+	if err := u.UnmarshalSereal(Value{d: d, b: b, idx: idx, st: st, target: ptr}); err != nil {
+		return 0, err
+	}
+
+	sz, err := st.valueLength(b, idx)
+	if err != nil {
+		return 0, err
+	}
+
+	if trackme {
+		st.tracked[idx] = ptr
+	}
+
+	return sz, nil
+}
+
+// valueLength returns the length of the value at b[idx:].  Values nest, so
+// scanning each one an Unmarshaler or DecodeFunc was handed would take
+// quadratic time; the methods of Value record the length of what they decode
+// instead, leaving only values skipped altogether to scan.
+func (st *decodeState) valueLength(b []byte, idx int) (int, error) {
+	if st.lastLen > 0 && st.lastIdx == idx {
+		return st.lastLen, nil
+	}
+
+	return bodyLength(b[idx:])
+}
+
+// setValueLength records the length of the value at idx, which contains the
+// values recorded before it
+func (st *decodeState) setValueLength(idx, sz int) {
+	st.lastIdx, st.lastLen = idx, sz
+}
+
+// isReference reports whether v refers to a value, which copies of v share.
+// Byte slices are strings to Perl, and *PerlUndef is undef.
+func isReference(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr:
+		return v.Type() != perlUndefType
+	case reflect.Map:
+		return true
+	case reflect.Slice:
+		return v.Type().Elem().Kind() != reflect.Uint8
+	}
+
+	return false
+}
+
+// isReferent reports whether e, tracked at offs, is the value referenced by
+// the REFN preceding it in PerlCompat mode.  Other interfaces tracked are
+// where values were stored, such as array elements.
+func isReferent(tracked map[int]reflect.Value, offs int, e reflect.Value) bool {
+	if !e.CanAddr() {
+		return false
+	}
+
+	if e.Kind() != reflect.Interface {
+		return true
+	}
+
+	// a tracked REFN refers to an interface, see decode
+	r, ok := tracked[offs-1]
+	return ok && r.Kind() == reflect.Ptr && r.Pointer() == e.UnsafeAddr()
+}
+
+// isShared reports whether the REFP or ALIAS at idx refers to a value decoded
+// before, which ptr can share rather than decoding it again
+func isShared(b []byte, idx int, tag byte, tracked map[int]reflect.Value, ptr reflect.Value) bool {
+	if tag != typeREFP && tag != typeALIAS {
+		return false
+	}
+
+	offs, _, err := readVarint(b[idx+1:])
+	if err != nil {
+		return false
+	}
+
+	e, ok := tracked[offs]
+	if !ok {
+		return false
+	}
+
+	if tag == typeREFP {
+		return ptr.Kind() == reflect.Ptr && e.CanAddr() && e.Addr().Type() == ptr.Type()
+	}
+
+	return e.Type().AssignableTo(ptr.Type())
+}
+
+func setInt(v reflect.Value, k reflect.Kind, i int) error {
 	if v.Kind() == reflect.Interface && v.IsNil() {
 		switch k {
 		case reflect.Uint:
@@ -927,7 +1545,7 @@ func setInt(v reflect.Value, k reflect.Kind, i int) {
 		case reflect.Int:
 			v.Set(reflect.ValueOf(i))
 		}
-		return
+		return nil
 	}
 
 	switch v.Kind() {
@@ -936,11 +1554,13 @@ func setInt(v reflect.Value, k reflect.Kind, i int) {
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		v.SetUint(uint64(i))
 	default:
-		panic("bad type for setInt: " + v.Kind().String())
+		return ErrTypeMismatch
 	}
+
+	return nil
 }
 
-func setFloat(v reflect.Value, k reflect.Kind, f float64) {
+func setFloat(v reflect.Value, k reflect.Kind, f float64) error {
 
 	if v.Kind() == reflect.Interface && v.IsNil() {
 		switch k {
@@ -949,81 +1569,88 @@ func setFloat(v reflect.Value, k reflect.Kind, f float64) {
 		case reflect.Float64:
 			v.Set(reflect.ValueOf(float64(f)))
 		}
-		return
-	}
-
-	v.SetFloat(f)
-}
-
-var structTagsCache = make(map[reflect.Type]map[string]int)
-
-func getStructTags(ptr reflect.Value) map[string]int {
-	if ptr.Kind() != reflect.Struct {
 		return nil
 	}
 
-	t := ptr.Type()
-
-	if m, ok := structTagsCache[t]; ok {
-		return m
+	if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+		return ErrTypeMismatch
 	}
 
-	m := make(map[string]int)
+	v.SetFloat(f)
+	return nil
+}
 
-	l := t.NumField()
-	numTags := 0
-	for i := 0; i < l; i++ {
-		field := t.Field(i).Tag.Get("sereal")
-		if field != "" {
-			m[field] = i
-			numTags++
+// decodeEntries decodes the ln keys and values at b[idx:] of a hash decoded
+// into ptr, storing them into href, and returns the index after them
+func (d *Decoder) decodeEntries(b []byte, idx, ln int, st *decodeState, ptr, href reflect.Value) (int, error) {
+	fields := getStructFields(ptr)
+
+	for i := 0; i < ln; i++ {
+		key, sz, err := d.decodeKey(b, idx, st)
+		if err != nil {
+			return 0, err
 		}
-	}
+		idx += sz
 
-	if numTags != 0 {
-		structTagsCache[t] = m
-		return m
-	}
+		// straight into the field, unless it needs parsing
+		if f, ok := fields.lookup(key); ok && !f.asString {
+			fv, _ := f.field(ptr, true)
+			sz, err = d.decodePlanned(b, idx, st, fv, f.plan)
+			if err != nil {
+				return 0, prependPath(err, "."+key)
+			}
+			idx += sz
+			continue
+		}
 
-	// build one from the public names
-	for i := 0; i < l; i++ {
-		pkgpath := t.Field(i).PkgPath
-		if pkgpath == "" { // exported
-			field := t.Field(i).Name
-			m[field] = i
-			numTags++
+		rval, _ := getValue(ptr, key, fields)
+		sz, err = d.decode(b, idx, st, rval)
+		if err != nil {
+			return 0, prependPath(err, "."+key)
+		}
+		idx += sz
+		if err := setKeyValue(href, key, rval, fields); err != nil {
+			return 0, err
 		}
 	}
 
-	if numTags != 0 {
-		structTagsCache[t] = m
-		return m
+	return idx, nil
+}
+
+// decodeKey decodes the hash key at b[idx:] and returns its size.  Most keys
+// are plain strings, which need no reflection.
+func (d *Decoder) decodeKey(b []byte, idx int, st *decodeState) (string, int, error) {
+	if s, sz, ok := (Value{d: d, b: b, idx: idx}).rawString(); ok {
+		return string(s), sz, nil
 	}
 
-	structTagsCache[t] = nil
-	return nil
+	var key string
+	sz, err := d.decode(b, idx, st, reflect.ValueOf(&key).Elem())
+	return key, sz, err
 }
 
-func getValue(ptr reflect.Value, key string, tags map[string]int) (reflect.Value, bool) {
+func getValue(ptr reflect.Value, key string, fields *structFields) (reflect.Value, bool) {
 	if ptr.Kind() == reflect.Map {
 		return reflect.New(ptr.Type().Elem()).Elem(), true
 	}
 
 	if ptr.Kind() == reflect.Struct {
 
-		if tags == nil {
+		if fields == nil {
 			// struct has no public fields
 			var iface interface{}
 			return reflect.ValueOf(&iface).Elem(), false
 		}
 
-		if i, ok := tags[key]; ok {
-			return ptr.Field(i), true
-		}
+		if f, ok := fields.lookup(key); ok {
+			if f.asString {
+				// decoded as is, parsed by setKeyValue
+				var iface interface{}
+				return reflect.ValueOf(&iface).Elem(), true
+			}
 
-		tkey := strings.Title(key)
-		if i, ok := tags[tkey]; ok {
-			return ptr.Field(i), true
+			fv, _ := f.field(ptr, true)
+			return fv, true
 		}
 
 		// unknown field name
@@ -1036,52 +1663,78 @@ func getValue(ptr reflect.Value, key string, tags map[string]int) (reflect.Value
 	return reflect.ValueOf(&iface).Elem(), false
 }
 
-func setKeyValue(ptr reflect.Value, key string, val reflect.Value, tags map[string]int) {
+func setKeyValue(ptr reflect.Value, key string, val reflect.Value, fields *structFields) error {
 
 	if ptr.Kind() == reflect.Map {
 		if ptr.IsNil() {
 			ptr.Set(reflect.MakeMap(ptr.Type()))
 		}
-		ptr.SetMapIndex(reflect.ValueOf(key), val)
-		return
+		k, err := mapKey(ptr.Type().Key(), key)
+		if err != nil {
+			return err
+		}
+		ptr.SetMapIndex(k, val)
+		return nil
 	}
 
 	if ptr.Kind() == reflect.Struct {
 
-		if tags == nil {
+		if fields == nil {
 			// no public fields, nothing to set
-			return
-		}
-
-		// look for the key we know
-		if i, ok := tags[key]; ok {
-			f := ptr.Field(i)
-			f.Set(val)
-			return
+			return nil
 		}
 
-		// look for the title-cased key
-		tkey := strings.Title(key)
-		if i, ok := tags[tkey]; ok {
-			f := ptr.Field(i)
-			f.Set(val)
-			return
+		// look for the key we know, or its title-cased version
+		if f, ok := fields.lookup(key); ok {
+			fv, _ := f.field(ptr, true)
+			if f.asString {
+				return setStringable(fv, val)
+			}
+			fv.Set(val)
+			return nil
 		}
 
 		// not found
-		return
+		return nil
 	}
 
 	if ptr.Kind() == reflect.Interface && ptr.Elem().Kind() == reflect.Map {
 		ptr.Elem().SetMapIndex(reflect.ValueOf(key), val)
-		return
+		return nil
 	}
 
-	panic("unknown type for setKeyValue: " + ptr.Kind().String())
+	return ErrTypeMismatch
+}
+
+// mapKey converts the hash key into a key of type kt.  Like encoding/json,
+// numeric, boolean and encoding.TextUnmarshaler keys are parsed from the string.
+func mapKey(kt reflect.Type, key string) (reflect.Value, error) {
+	rkey := reflect.ValueOf(key)
 
+	switch {
+	case planFor(kt).textUnmarshaler.byAddress:
+		k := reflect.New(kt)
+		if err := k.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(key)); err != nil {
+			return reflect.Value{}, err
+		}
+		return k.Elem(), nil
+
+	case kt.Kind() == reflect.String:
+		return rkey.Convert(kt), nil
+
+	case isStringable(kt.Kind()):
+		k := reflect.New(kt).Elem()
+		return k, setStringable(k, rkey)
+
+	case kt.Kind() == reflect.Interface && kt.NumMethod() == 0:
+		return rkey, nil
+
+	default:
+		return reflect.Value{}, ErrTypeMismatch
+	}
 }
 
-func setString(slice reflect.Value, b []byte) {
+func setString(slice reflect.Value, b []byte) error {
 
 	switch slice.Kind() {
 
@@ -1090,80 +1743,60 @@ func setString(slice reflect.Value, b []byte) {
 	case reflect.String:
 		slice.SetString(string(b))
 	default:
-		panic("bad type for setString: " + slice.Kind().String())
-	}
-}
-
-func stringOf(v reflect.Value) string {
-
-	if v.Type().Kind() == reflect.Ptr {
-		return stringOf(v.Elem())
-	}
-
-	if v.Type().Kind() == reflect.String {
-		return v.String()
+		return ErrTypeMismatch
 	}
 
-	if (v.Type().Kind() == reflect.Array || v.Type().Kind() == reflect.Slice) && (v.Type().Elem().Kind() == reflect.Uint8) {
-		return string(v.Bytes())
-	}
-
-	panic("bad value for stringOf")
+	return nil
 }
 
 func isStringish(b []byte, idx int) bool {
+	tag, idx, ok := tagAt(b, idx)
 
-	if idx < 0 || idx >= len(b) {
-		return false
-	}
-
-	tag := b[idx]
-
-	// skip over any padding bytes
-	for tag == typePAD || tag == typePAD|trackFlag {
-		idx++
-		if idx >= len(b) {
+	if ok && tag == typeCOPY {
+		// of an earlier string, not of another COPY
+		offs, _, err := readVarint(b[idx+1:])
+		if err != nil || offs < 0 || offs >= idx {
 			return false
 		}
-		tag = b[idx]
+		tag, _, ok = tagAt(b, offs)
 	}
 
-	tag &^= trackFlag
-
-	if tag == typeCOPY {
-		idx++
+	return ok && isShallowStringish(tag)
+}
 
-		offs, sz := varintdecode(b[idx:])
-		idx += sz
+// tagAt returns the tag at b[idx:] without its track flag, and its position
+// after any padding bytes
+func tagAt(b []byte, idx int) (byte, int, bool) {
+	if idx < 0 {
+		return 0, 0, false
+	}
 
-		if offs < 0 || offs >= len(b) {
-			return false
+	for ; idx < len(b); idx++ {
+		if tag := b[idx] &^ trackFlag; tag != typePAD {
+			return tag, idx, true
 		}
-		return isStringish(b, offs)
 	}
 
-	return tag == typeBINARY || tag == typeSTR_UTF8 || (tag >= typeSHORT_BINARY_0 && tag <= typeSHORT_BINARY_0+31)
+	return 0, 0, false
 }
 
-func varintdecode(by []byte) (n int, sz int) {
-
-	s := uint(0) // shift count
-	for i, b := range by {
-		n |= int(b&0x7f) << s
-		s += 7
-
-		if (b & 0x80) == 0 {
-			return n, i + 1
-		}
-
-		if s > 63 {
-			// too many continuation bits
-			panic("bad varint")
-		}
+// isNested reports whether tag starts a reference, array, hash or object,
+// which count towards MaxRecursionDepth
+func isNested(tag byte) bool {
+	switch tag {
+	case typeREFN, typeARRAY, typeHASH, typeWEAKEN:
+		return true
+	case typeOBJECT, typeOBJECTV, typeOBJECT_FREEZE, typeOBJECTV_FREEZE:
+		return true
 	}
 
-	// byte without continuation bit
-	panic("bad varint")
+	switch {
+	case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
+		return true
+	case tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+		return true
+	}
+	return false
 }
 
 func findUnmarshaler(ptr reflect.Value) (encoding.BinaryUnmarshaler, bool) {
@@ -1207,6 +1840,47 @@ func RegisterName(name string, value interface{}) {
 	panic(fmt.Sprintf("unable to register type %s: not encoding.BinaryUnmarshaler", rv.Type()))
 }
 
+var thawFuncs = make(map[string]func(args []interface{}) (interface{}, error))
+
+// RegisterThaw registers thaw as the THAW implementation of the named class.
+// When the decoder finds a FREEZE tag with the given class while decoding into
+// an interface, thaw is called with the values returned by the class' FREEZE
+// method, and its result is used in place of the frozen object.
+func RegisterThaw(class string, thaw func(args []interface{}) (interface{}, error)) {
+	registerLock.Lock()
+	defer registerLock.Unlock()
+
+	thawFuncs[class] = thaw
+}
+
+// freezeValues returns the values of a decoded FREEZE payload, which the spec
+// requires to be an array reference.  Older encoders wrote a single binary
+// string instead.  data is set if the payload holds a single string, which is
+// what MarshalBinary produces.
+func freezeValues(payload interface{}) (values []interface{}, data []byte, err error) {
+	switch p := payload.(type) {
+	case []byte:
+		values = []interface{}{p}
+	case []interface{}:
+		values = p
+	case *[]interface{}:
+		values = *p
+	default:
+		return nil, nil, ErrCorrupt{errBadFreeze}
+	}
+
+	if len(values) == 1 {
+		switch v := values[0].(type) {
+		case []byte:
+			data = v
+		case string:
+			data = []byte(v)
+		}
+	}
+
+	return values, data, nil
+}
+
 func instantiateZero(typ reflect.Type) reflect.Value {
 
 	if typ.Kind() == reflect.Ptr {
@@ -2,24 +2,63 @@ package sereal
 
 import (
 	"encoding"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
+	"math/big"
 	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
+	"sync"
 	"unsafe"
 )
 
 // An Encoder encodes Go data structures into Sereal byte streams
 type Encoder struct {
-	PerlCompat           bool       // try to mimic Perl's structure as much as possible
-	Compression          compressor // optionally compress the main payload of the document using SnappyCompressor or ZlibCompressor
-	CompressionThreshold int        // threshold in bytes above which compression is attempted: 1024 bytes by default
-	DisableDedup         bool       // should we disable deduping of class names and hash keys
-	DisableFREEZE        bool       // should we disable the FREEZE tag, which calls MarshalBinary
-	ExpectedSize         uint       // give a hint to encoder about expected size of encoded data
-	version              int        // default version to encode
+	PerlCompat           bool             // try to mimic Perl's structure as much as possible
+	Canonical            bool             // emit hash keys in sorted order, so equal values encode to equal bytes
+	Compact              bool             // use ARRAYREF/HASHREF tags for small containers in PerlCompat mode and OBJECTV tags for repeated class names
+	Compression          compressor       // optionally compress the main payload of the document using SnappyCompressor or ZlibCompressor
+	CompressionThreshold int              // threshold in bytes above which compression is attempted: 1024 bytes by default
+	DisableDedup         bool             // should we disable deduping of class names and hash keys
+	DisableFREEZE        bool             // should we disable the FREEZE tag, which calls MarshalBinary
+	UnblessedStructs     bool             // encode structs as plain hashes instead of objects blessed into their class
+	DedupeStrings        bool             // write repeated string values longer than 3 bytes as a COPY of the first one
+	AliasedDedupeStrings bool             // like DedupeStrings, but write an ALIAS so decoders share a single string
+	ExpectedSize         uint             // give a hint to encoder about expected size of encoded data; adapted to the size of recent documents
+	MaxDepth             int              // maximum nesting depth of containers and pointers; 0 means no limit
+	Unknown              UnknownPolicy    // what to do with values of unsupported types; ErrorOnUnknown by default
+	LongDouble           LongDoubleFormat // encode *big.Float values as LONG_DOUBLE in this format, rather than as strings
+	version              int              // default version to encode
+	typeEncoders         map[reflect.Type]EncodeFunc
+
+	// state of the document being encoded, see newSession
+	stream *streamWriter
+	depth  int
+	state  *encodeState
+}
+
+// An UnknownPolicy tells the encoder what to do with values of types it has no
+// representation for, such as channels, functions and complex numbers
+type UnknownPolicy int
+
+const (
+	ErrorOnUnknown   UnknownPolicy = iota // fail with an *UnsupportedTypeError
+	UndefUnknown                          // encode them as undef, and leave out map entries with such keys
+	StringifyUnknown                      // encode them as strings, formatted by fmt.Sprint
+)
+
+// An EncodeFunc returns the value to encode in place of v, for types which
+// can't implement Marshaler themselves
+type EncodeFunc func(v reflect.Value) (interface{}, error)
+
+// RegisterType makes the encoder call fn to encode values of type t
+func (e *Encoder) RegisterType(t reflect.Type, fn EncodeFunc) {
+	if e.typeEncoders == nil {
+		e.typeEncoders = make(map[reflect.Type]EncodeFunc)
+	}
+	e.typeEncoders[t] = fn
 }
 
 type compressor interface {
@@ -67,6 +106,15 @@ func (e *Encoder) Marshal(body interface{}) (b []byte, err error) {
 
 // MarshalWithHeader returns the Sereal encoding of body with header data
 func (e *Encoder) MarshalWithHeader(header interface{}, body interface{}) (b []byte, err error) {
+	return e.MarshalAppend(nil, header, body)
+}
+
+// MarshalAppend appends the Sereal encoding of body with header data to dst
+// and returns the extended buffer.
+//
+// The tables and buffers used while encoding are reused between calls, so
+// apart from growing dst, encoding maps, slices and scalars doesn't allocate.
+func (e *Encoder) MarshalAppend(dst []byte, header interface{}, body interface{}) (b []byte, err error) {
 	defer func() {
 		//return
 		if r := recover(); r != nil {
@@ -87,62 +135,49 @@ func (e *Encoder) MarshalWithHeader(header interface{}, body interface{}) (b []b
 		e.version = ProtocolVersion
 	}
 
-	encHeader := make([]byte, headerSize, 32)
-
-	if e.version < 3 {
-		binary.LittleEndian.PutUint32(encHeader[:4], magicHeaderBytes)
-	} else {
-		binary.LittleEndian.PutUint32(encHeader[:4], magicHeaderBytesHighBit)
-	}
-
-	// Set the <version-type> component in the header
-	encHeader[4] = byte(e.version) | byte(serealRaw)<<4
-
+	var encHeader []byte
 	if header != nil && e.version >= 2 {
-		strTable := make(map[string]int)
-		ptrTable := make(map[uintptr]int)
-		// this is both the flag byte (== "there is user data") and also a hack to make 1-based offsets work
-		henv := []byte{0x01} // flag byte == "there is user data"
-		encHeaderSuffix, err := e.encode(henv, header, false, false, strTable, ptrTable)
+		hs := e.newSession()
+		defer hs.release()
 
-		if err != nil {
+		if encHeader, err = hs.encodeHeaderSuffix(header); err != nil {
 			return nil, err
 		}
-
-		encHeader = varint(encHeader, uint(len(encHeaderSuffix)))
-		encHeader = append(encHeader, encHeaderSuffix...)
-	} else {
-		/* header size */
-		encHeader = append(encHeader, 0)
 	}
 
-	strTable := make(map[string]int)
-	ptrTable := make(map[uintptr]int)
+	se := e.newSession()
+	defer se.release()
 
-	var encBody []byte
-	encBody = make([]byte, 0, e.ExpectedSize)
+	st := se.state
+	encBody := st.buf[:0]
 
+	var pad int
 	switch e.version {
 	case 1:
-		encBody, err = e.encode(encBody, body, false, false, strTable, ptrTable)
+		// v1 offsets are relative to the start of the document, the
+		// header of which is always headerSize+1 bytes
+		pad = headerSize + 1
 	case 2, 3:
-		encBody = append(encBody, 0) // hack for 1-based offsets
-		encBody, err = e.encode(encBody, body, false, false, strTable, ptrTable)
-		encBody = encBody[1:] // trim hacky first byte
+		pad = 1 // hack for 1-based offsets
 	}
 
+	encBody = append(encBody, bodyPad[:pad]...)
+	encBody, err = se.encode(encBody, body, false, false, st.strTable, st.ptrTable, st.objTable)
 	if err != nil {
 		return nil, err
 	}
 
+	st.buf = encBody
+	encBody = encBody[pad:]
+
+	doctype := serealRaw
+
 	if e.Compression != nil && (e.CompressionThreshold == 0 || len(encBody) >= e.CompressionThreshold) {
 		encBody, err = e.Compression.compress(encBody)
 		if err != nil {
 			return nil, err
 		}
 
-		var doctype documentType
-
 		switch c := e.Compression.(type) {
 		case SnappyCompressor:
 			if e.version > 1 && !c.Incremental {
@@ -167,19 +202,71 @@ func (e *Encoder) MarshalWithHeader(header interface{}, body interface{}) (b []b
 			// but a relevant document type is not defined.
 			panic("undefined compression")
 		}
+	}
 
-		encHeader[4] |= byte(doctype) << 4
+	// grow dst once to hold the whole document
+	if n := len(dst) + headerSize + varintLen(uint(len(encHeader))) + len(encHeader) + len(encBody); n > cap(dst) {
+		grown := make([]byte, len(dst), n)
+		copy(grown, dst)
+		dst = grown
 	}
 
-	return append(encHeader, encBody...), nil
+	dst = e.appendHeader(dst, encHeader, doctype)
+	return append(dst, encBody...), nil
+}
+
+// bodyPad is the placeholder for the bytes preceding the body, which offsets
+// in the body count
+var bodyPad [headerSize + 1]byte
+
+// appendHeader appends the document header to dst: magic, version-type byte
+// and the optional header suffix (v2 and up)
+func (e *Encoder) appendHeader(dst []byte, suffix []byte, doctype documentType) []byte {
+	magic := magicHeaderBytes
+	if e.version >= 3 {
+		magic = magicHeaderBytesHighBit
+	}
+
+	dst = append(dst, byte(magic), byte(magic>>8), byte(magic>>16), byte(magic>>24))
+
+	// Set the <version-type> component in the header
+	dst = append(dst, byte(e.version)|byte(doctype)<<4)
+
+	dst = varint(dst, uint(len(suffix)))
+	return append(dst, suffix...)
+}
+
+// encodeHeaderSuffix returns the user data part of the document header,
+// which is only valid until the session is released
+func (e *Encoder) encodeHeaderSuffix(header interface{}) ([]byte, error) {
+	st := e.state
+
+	// this is both the flag byte (== "there is user data") and also a hack to make 1-based offsets work
+	henv := append(st.buf[:0], 0x01)
+	b, err := e.encode(henv, header, false, false, st.strTable, st.ptrTable, st.objTable)
+	if err != nil {
+		return nil, err
+	}
+
+	st.buf = b
+	return b, nil
 }
 
 /*************************************
  * Encode via static types - fast path
  *************************************/
-func (e *Encoder) encode(b []byte, v interface{}, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+func (e *Encoder) encode(b []byte, v interface{}, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
 	var err error
 
+	if fn, ok := e.typeEncoders[reflect.TypeOf(v)]; ok {
+		r, err := fn(reflect.ValueOf(v))
+		if err != nil {
+			return nil, err
+		}
+
+		return e.encode(b, r, isKeyOrClass, isRefNext, strTable, ptrTable, objTable)
+	}
+
 	switch value := v.(type) {
 	case nil:
 		b = append(b, typeUNDEF)
@@ -219,23 +306,30 @@ func (e *Encoder) encode(b []byte, v interface{}, isKeyOrClass bool, isRefNext b
 		b = e.encodeDouble(b, value)
 
 	case string:
-		b = e.encodeString(b, value, isKeyOrClass, strTable)
+		if isKeyOrClass {
+			b = e.encodeString(b, value, true, strTable)
+		} else {
+			b = e.encodeStringValue(b, value, false, isRefNext)
+		}
 
 	case []uint8:
-		b = e.encodeBytes(b, value, isKeyOrClass, strTable)
+		if isKeyOrClass || !(e.DedupeStrings || e.AliasedDedupeStrings) {
+			b = e.encodeBytes(b, value, isKeyOrClass, strTable)
+		} else {
+			b = e.encodeStringValue(b, string(value), true, isRefNext)
+		}
 
 	case []interface{}:
-		b, err = e.encodeIntfArray(b, value, isRefNext, strTable, ptrTable)
+		b, err = e.encodeIntfArray(b, value, isRefNext, strTable, ptrTable, objTable)
 
 	case map[string]interface{}:
-		b, err = e.encodeStrMap(b, value, isRefNext, strTable, ptrTable)
+		b, err = e.encodeStrMap(b, value, isRefNext, strTable, ptrTable, objTable)
 
 	case reflect.Value:
 		if value.Kind() == reflect.Invalid {
 			b = append(b, typeUNDEF)
 		} else {
-			// could be optimized to tail call
-			b, err = e.encode(b, value.Interface(), false, isRefNext, strTable, ptrTable)
+			b, err = typeEncoder(value.Type())(e, b, value, false, isRefNext, strTable, ptrTable, objTable)
 		}
 
 	case PerlUndef:
@@ -246,9 +340,15 @@ func (e *Encoder) encode(b []byte, v interface{}, isKeyOrClass bool, isRefNext b
 		}
 
 	case PerlObject:
-		b = append(b, typeOBJECT)
-		b = e.encodeBytes(b, []byte(value.Class), true, strTable)
-		b, err = e.encode(b, value.Reference, false, false, strTable, ptrTable)
+		b = e.encodeClass(b, typeOBJECT, value.Class, strTable, objTable)
+		b, err = e.encode(b, value.Reference, false, false, strTable, ptrTable, objTable)
+
+	case PerlFreeze:
+		b = e.encodeClass(b, typeOBJECT_FREEZE, value.Class, strTable, objTable)
+		b, err = e.encodeFreezeValues(b, value.values(), strTable, ptrTable, objTable)
+
+	case *PerlFreeze:
+		b, err = e.encodeFreeze(b, value, strTable, ptrTable, objTable)
 
 	case PerlRegexp:
 		b = append(b, typeREGEXP)
@@ -257,7 +357,13 @@ func (e *Encoder) encode(b []byte, v interface{}, isKeyOrClass bool, isRefNext b
 
 	case PerlWeakRef:
 		b = append(b, typeWEAKEN)
-		b, err = e.encode(b, value.Reference, false, false, strTable, ptrTable)
+		b, err = e.encode(b, value.Reference, false, false, strTable, ptrTable, objTable)
+
+	case *PerlAlias:
+		b, err = e.encodeAlias(b, value, isRefNext, strTable, ptrTable, objTable)
+
+	case PerlAlias:
+		b, err = e.encode(b, value.Alias, false, isRefNext, strTable, ptrTable, objTable)
 
 	//case *interface{}:
 	//TODO handle here if easy
@@ -274,7 +380,8 @@ func (e *Encoder) encode(b []byte, v interface{}, isKeyOrClass bool, isRefNext b
 	// if one manages to properly implement *interface{} case, this block should be uncommented
 
 	default:
-		b, err = e.encodeViaReflection(b, reflect.ValueOf(value), isKeyOrClass, isRefNext, strTable, ptrTable)
+		rv := reflect.ValueOf(value)
+		b, err = typeEncoder(rv.Type())(e, b, rv, isKeyOrClass, isRefNext, strTable, ptrTable, objTable)
 	}
 
 	return b, err
@@ -337,7 +444,7 @@ func (e *Encoder) encodeString(by []byte, s string, isKeyOrClass bool, strTable
 			by = varint(by, uint(copyOffs))
 			return by
 		} else {
-			strTable[s] = len(by)
+			strTable[s] = e.offset(by)
 		}
 	}
 
@@ -346,6 +453,100 @@ func (e *Encoder) encodeString(by []byte, s string, isKeyOrClass bool, strTable
 	return append(by, s...)
 }
 
+// strValueKey identifies a string value for DedupeStrings.  Strings and
+// binaries with the same contents decode to different types in Go, so they
+// are never deduplicated against each other.
+type strValueKey struct {
+	s      string
+	binary bool
+}
+
+// encodeStringValue writes a string value, or a byte slice if binary is true.
+// With DedupeStrings or AliasedDedupeStrings, values seen before are written
+// as a COPY or ALIAS of their first occurrence.
+func (e *Encoder) encodeStringValue(by []byte, s string, binary bool, isRefNext bool) []byte {
+	if !(e.DedupeStrings || e.AliasedDedupeStrings) || len(s) <= 3 {
+		if binary {
+			return e.encodeBytes(by, []byte(s), false, nil)
+		}
+		return e.encodeString(by, s, false, nil)
+	}
+
+	key := strValueKey{s, binary}
+
+	if offs, ok := e.state.strValues[key]; ok {
+		// an ALIAS can't follow a REFN, which needs a value of its own
+		if e.AliasedDedupeStrings && !isRefNext {
+			by = append(by, typeALIAS)
+			by = varint(by, uint(offs))
+			e.setTrackFlag(by, offs)
+			return by
+		}
+
+		by = append(by, typeCOPY)
+		return varint(by, uint(offs))
+	}
+
+	if e.state.strValues == nil {
+		e.state.strValues = make(map[strValueKey]int)
+	}
+
+	start := len(by)
+	e.state.strValues[key] = e.offset(by)
+
+	if binary {
+		by = e.encodeBytes(by, []byte(s), false, nil)
+	} else {
+		by = e.encodeString(by, s, false, nil)
+	}
+
+	if e.AliasedDedupeStrings && e.stream != nil {
+		// no going back once it's flushed
+		by[start] |= trackFlag
+	}
+
+	return by
+}
+
+// encodeAlias writes the value of a, or an ALIAS of its first occurrence if a
+// was encoded before, so values aliased in Perl are aliased again
+func (e *Encoder) encodeAlias(by []byte, a *PerlAlias, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	if a == nil {
+		return append(by, typeUNDEF), nil
+	}
+
+	// an ALIAS can't follow a REFN, which needs a value of its own
+	if offs, ok := e.state.aliases[a]; ok && !isRefNext {
+		by = append(by, typeALIAS)
+		by = varint(by, uint(offs))
+		e.setTrackFlag(by, offs)
+		return by, nil
+	}
+
+	if e.state.aliases == nil {
+		e.state.aliases = make(map[*PerlAlias]int)
+	}
+
+	offs := e.offset(by)
+	e.state.aliases[a] = offs
+
+	if e.stream != nil {
+		// the value may be flushed before we know whether it's aliased
+		e.stream.pending = append(e.stream.pending, offs)
+	}
+
+	by, err := e.encode(by, a.Alias, false, isRefNext, strTable, ptrTable, objTable)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.stream != nil {
+		by = e.stream.popPending(by)
+	}
+
+	return by, nil
+}
+
 func (e *Encoder) encodeBytes(by []byte, byt []byte, isKeyOrClass bool, strTable map[string]int) []byte {
 	if !e.DisableDedup && isKeyOrClass {
 		if copyOffs, ok := strTable[string(byt)]; ok {
@@ -354,7 +555,7 @@ func (e *Encoder) encodeBytes(by []byte, byt []byte, isKeyOrClass bool, strTable
 			return by
 		} else {
 			// save for later
-			strTable[string(byt)] = len(by)
+			strTable[string(byt)] = e.offset(by)
 		}
 	}
 
@@ -368,20 +569,32 @@ func (e *Encoder) encodeBytes(by []byte, byt []byte, isKeyOrClass bool, strTable
 	return append(by, byt...)
 }
 
-func (e *Encoder) encodeIntfArray(by []byte, arr []interface{}, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
-	if e.PerlCompat && !isRefNext {
-		by = append(by, typeREFN)
+func (e *Encoder) encodeIntfArray(by []byte, arr []interface{}, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	l := len(arr)
+
+	var key containerKey
+	if l > 0 {
+		key = containerKey{unsafe.Pointer(&arr[0]), l}
 	}
 
-	// TODO implement ARRAYREF for small arrays
+	if c, ok := e.state.containers[key]; ok {
+		return e.encodeSeenContainer(by, c, isRefNext), nil
+	}
 
-	l := len(arr)
-	by = append(by, typeARRAY)
-	by = varint(by, uint(l))
+	e.enter()
+	defer e.leave()
+
+	start := len(by)
+	by = e.encodeArrayHeader(by, l, isRefNext)
+	e.trackContainer(by, start, key)
 
 	var err error
 	for i := 0; i < l; i++ {
-		if by, err = e.encode(by, arr[i], false, false, strTable, ptrTable); err != nil {
+		if by, err = e.encode(by, arr[i], false, false, strTable, ptrTable, objTable); err != nil {
+			return nil, prependPath(err, "["+strconv.Itoa(i)+"]")
+		}
+
+		if by, err = e.maybeFlush(by); err != nil {
 			return nil, err
 		}
 	}
@@ -389,87 +602,471 @@ func (e *Encoder) encodeIntfArray(by []byte, arr []interface{}, isRefNext bool,
 	return by, nil
 }
 
-func (e *Encoder) encodeStrMap(by []byte, m map[string]interface{}, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+func (e *Encoder) encodeStrMap(by []byte, m map[string]interface{}, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	key := containerKey{unsafe.Pointer(reflect.ValueOf(m).Pointer()), len(m)}
+
+	if c, ok := e.state.containers[key]; ok {
+		return e.encodeSeenContainer(by, c, isRefNext), nil
+	}
+
+	e.enter()
+	defer e.leave()
+
+	start := len(by)
+	by = e.encodeHashHeader(by, len(m), isRefNext)
+	e.trackContainer(by, start, key)
+
+	var err error
+	if e.Canonical {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if by, err = e.encodeStrMapEntry(by, k, m[k], strTable, ptrTable, objTable); err != nil {
+				return by, err
+			}
+		}
+	} else {
+		for k, v := range m {
+			if by, err = e.encodeStrMapEntry(by, k, v, strTable, ptrTable, objTable); err != nil {
+				return by, err
+			}
+		}
+	}
+
+	return by, nil
+}
+
+func (e *Encoder) encodeStrMapEntry(by []byte, k string, v interface{}, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	var err error
+
+	by = e.encodeString(by, k, true, strTable)
+	if by, err = e.encode(by, v, false, false, strTable, ptrTable, objTable); err != nil {
+		return by, prependPath(err, "["+strconv.Quote(k)+"]")
+	}
+
+	return e.maybeFlush(by)
+}
+
+// encodeArrayHeader writes the tags introducing an array of l elements.  In
+// PerlCompat mode arrays are references, which in compact mode is done with a
+// single ARRAYREF tag for small arrays.
+func (e *Encoder) encodeArrayHeader(by []byte, l int, isRefNext bool) []byte {
 	if e.PerlCompat && !isRefNext {
+		if e.Compact && l < 16 {
+			return append(by, typeARRAYREF_0+byte(l))
+		}
+
 		by = append(by, typeREFN)
 	}
 
-	// TODO implement HASHREF for small maps
+	by = append(by, typeARRAY)
+	return varint(by, uint(l))
+}
+
+// encodeHashHeader is encodeArrayHeader for hashes of l entries
+func (e *Encoder) encodeHashHeader(by []byte, l int, isRefNext bool) []byte {
+	if e.PerlCompat && !isRefNext {
+		if e.Compact && l < 16 {
+			return append(by, typeHASHREF_0+byte(l))
+		}
+
+		by = append(by, typeREFN)
+	}
 
 	by = append(by, typeHASH)
-	by = varint(by, uint(len(m)))
+	return varint(by, uint(l))
+}
 
-	var err error
-	for k, v := range m {
-		by = e.encodeString(by, k, true, strTable)
-		if by, err = e.encode(by, v, false, false, strTable, ptrTable); err != nil {
-			return by, err
+// encodeClass writes an OBJECT or OBJECT_FREEZE tag followed by the class
+// name.  In compact mode, classes seen before are written as OBJECTV or
+// OBJECTV_FREEZE referring to the first occurrence of the class name.
+func (e *Encoder) encodeClass(by []byte, tag byte, class string, strTable map[string]int, objTable map[string]int) []byte {
+	if e.Compact {
+		if offs, ok := objTable[class]; ok {
+			if tag == typeOBJECT {
+				by = append(by, typeOBJECTV)
+			} else {
+				by = append(by, typeOBJECTV_FREEZE)
+			}
+
+			return varint(by, uint(offs))
 		}
 	}
 
+	by = append(by, tag)
+	offs := e.offset(by)
+
+	if tag == typeOBJECT {
+		by = e.encodeBytes(by, []byte(class), true, strTable)
+	} else {
+		by = e.encodeString(by, class, true, strTable)
+	}
+
+	if !e.DisableDedup {
+		// the class name may have been written as a COPY, in which case
+		// decoders know it by the offset of the copied string
+		offs = strTable[class]
+	}
+
+	objTable[class] = offs
+	return by
+}
+
+// encodeFreeze writes the frozen object f, or a reference to its values if f
+// was encoded before, which is how Perl refers to the thawed object again
+func (e *Encoder) encodeFreeze(by []byte, f *PerlFreeze, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	if f == nil {
+		return append(by, typeUNDEF), nil
+	}
+
+	p := uintptr(unsafe.Pointer(f))
+
+	if offs, ok := ptrTable[p]; ok {
+		by = append(by, typeREFP)
+		by = varint(by, uint(offs))
+		e.setTrackFlag(by, offs)
+		return by, nil
+	}
+
+	by = e.encodeClass(by, typeOBJECT_FREEZE, f.Class, strTable, objTable)
+
+	// the values follow their REFN
+	offs := e.offset(by) + 1
+	ptrTable[p] = offs
+
+	if e.stream != nil {
+		e.stream.pending = append(e.stream.pending, offs)
+	}
+
+	by, err := e.encodeFreezeValues(by, f.values(), strTable, ptrTable, objTable)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.stream != nil {
+		by = e.stream.popPending(by)
+	}
+
 	return by, nil
 }
 
+// encodeFreezeValues writes the values returned by a FREEZE method, which the
+// spec requires to be in an array reference
+func (e *Encoder) encodeFreezeValues(by []byte, values []interface{}, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	by = append(by, typeREFN)
+	return e.encodeIntfArray(by, values, true, strTable, ptrTable, objTable)
+}
+
 /*************************************
  * Encode via reflection
  *************************************/
-func (e *Encoder) encodeViaReflection(b []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
-	var err error
 
-	if !e.DisableFREEZE && rv.Kind() != reflect.Invalid {
-		if m, ok := rv.Interface().(encoding.BinaryMarshaler); ok {
-			by, err := m.MarshalBinary()
+// An encoderFunc encodes values of a single type.  Whatever can be told from
+// the type alone, such as which marshaling interfaces it implements and the
+// encoders of its elements and fields, is worked out once when compiling it.
+type encoderFunc func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error)
+
+var encoderCache sync.Map // map[reflect.Type]encoderFunc
+
+// typeEncoder returns the encoder of t, compiling it the first time
+func typeEncoder(t reflect.Type) encoderFunc {
+	if f, ok := encoderCache.Load(t); ok {
+		return f.(encoderFunc)
+	}
+
+	// A recursive type reaches its own encoder while that's being compiled.
+	// It gets one which waits for the compiled encoder and calls it.
+	var (
+		wg sync.WaitGroup
+		f  encoderFunc
+	)
+
+	wg.Add(1)
+	fi, loaded := encoderCache.LoadOrStore(t, encoderFunc(func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+		wg.Wait()
+		return f(e, by, rv, isKeyOrClass, isRefNext, strTable, ptrTable, objTable)
+	}))
+	if loaded {
+		return fi.(encoderFunc)
+	}
+
+	f = newTypeEncoder(t)
+	wg.Done()
+	encoderCache.Store(t, f)
+	return f
+}
+
+// newTypeEncoder compiles the encoder of t.  Values of the types encode
+// switches on are encoded the same way as there, the others like
+// encoding/json does: via the marshaling interfaces they implement, or else
+// by their kind.
+func newTypeEncoder(t reflect.Type) encoderFunc {
+	if t.Kind() == reflect.Interface {
+		return encodeInterface
+	}
+
+	f := newValueEncoder(t)
+
+	// the encoder of a type registered with RegisterType comes first
+	return func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+		if fn, ok := e.typeEncoders[t]; ok {
+			r, err := fn(rv)
 			if err != nil {
 				return nil, err
 			}
 
-			b = append(b, typeOBJECT_FREEZE)
-			b = e.encodeString(b, concreteName(rv), true, strTable)
-			return e.encode(b, reflect.ValueOf(by), false, false, strTable, ptrTable)
+			return e.encode(by, r, isKeyOrClass, isRefNext, strTable, ptrTable, objTable)
 		}
+
+		return f(e, by, rv, isKeyOrClass, isRefNext, strTable, ptrTable, objTable)
+	}
+}
+
+func newValueEncoder(t reflect.Type) encoderFunc {
+	switch reflect.Zero(t).Interface().(type) {
+	case bool:
+		return encodeBool
+	case int, int8, int16, int32, int64:
+		return encodeSigned
+	case uint, uint8, uint16, uint32, uint64:
+		return encodeUnsigned
+	case float32:
+		return encodeFloat32
+	case float64:
+		return encodeFloat64
+	case string:
+		return encodeStringKind
+	case []uint8:
+		return encodeByteSlice
+	case []interface{}, map[string]interface{}, reflect.Value,
+		PerlUndef, PerlObject, PerlFreeze, *PerlFreeze, PerlRegexp, PerlWeakRef, *PerlAlias, PerlAlias:
+		return encodeStatic
+	}
+
+	// the marshaling interfaces are tried in this order, the first one
+	// ending up outermost
+	f := newKindEncoder(t)
+
+	if t.Implements(textMarshalerType) {
+		f = newTextMarshalerEncoder(t, f)
 	}
 
-	// make sure we're looking at a real type and not an interface
-	for rv.Kind() == reflect.Interface {
-		rv = rv.Elem()
+	if t.Implements(binaryMarshalerType) {
+		f = newBinaryMarshalerEncoder(t, f)
 	}
 
-	switch rk := rv.Kind(); rk {
+	if t.Implements(marshalerType) {
+		f = newMarshalerEncoder(t)
+	}
+
+	if t == bigFloatType || t == bigFloatType.Elem() {
+		f = newLongDoubleEncoder(t, f)
+	}
+
+	return f
+}
+
+func newKindEncoder(t reflect.Type) encoderFunc {
+	switch t.Kind() {
 	case reflect.Slice:
-		// uint8 case is handled in encode()
+		// []uint8 is encoded by encode, named byte slices are arrays
 		fallthrough
 
 	case reflect.Array:
-		b, err = e.encodeArray(b, rv, isRefNext, strTable, ptrTable)
+		return newArrayEncoder(t)
 
 	case reflect.Map:
-		b, err = e.encodeMap(b, rv, isRefNext, strTable, ptrTable)
+		return newMapEncoder(t)
 
 	case reflect.Struct:
-		b, err = e.encodeStruct(b, rv, strTable, ptrTable)
+		return newStructEncoder(t)
 
 	case reflect.Ptr:
-		b, err = e.encodePointer(b, rv, strTable, ptrTable)
+		return newPtrEncoder(t)
+	}
 
-	default:
-		panic(fmt.Sprintf("no support for type '%s' (%s)", rk.String(), rv.Type()))
+	return encodeUnknown
+}
+
+func encodeInterface(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	if rv.IsNil() {
+		return append(by, typeUNDEF), nil
 	}
 
-	return b, err
+	elem := rv.Elem()
+	return typeEncoder(elem.Type())(e, by, elem, false, isRefNext, strTable, ptrTable, objTable)
 }
 
-func (e *Encoder) encodeArray(by []byte, arr reflect.Value, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
-	if e.PerlCompat && !isRefNext {
-		by = append(by, typeREFN)
+func encodeBool(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	if rv.Bool() {
+		return append(by, typeTRUE), nil
+	}
+
+	return append(by, typeFALSE), nil
+}
+
+func encodeSigned(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	return e.encodeInt(by, reflect.Int, rv.Int()), nil
+}
+
+func encodeUnsigned(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	return e.encodeInt(by, reflect.Uint, int64(rv.Uint())), nil
+}
+
+func encodeFloat32(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	return e.encodeFloat(by, float32(rv.Float())), nil
+}
+
+func encodeFloat64(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	return e.encodeDouble(by, rv.Float()), nil
+}
+
+func encodeStringKind(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	if isKeyOrClass {
+		return e.encodeString(by, rv.String(), true, strTable), nil
+	}
+
+	return e.encodeStringValue(by, rv.String(), false, isRefNext), nil
+}
+
+func encodeByteSlice(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	if isKeyOrClass || !(e.DedupeStrings || e.AliasedDedupeStrings) {
+		return e.encodeBytes(by, rv.Bytes(), isKeyOrClass, strTable), nil
+	}
+
+	return e.encodeStringValue(by, string(rv.Bytes()), true, isRefNext), nil
+}
+
+// encodeStatic hands the generic containers and Perl types over to encode
+func encodeStatic(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	return e.encode(by, rv.Interface(), isKeyOrClass, isRefNext, strTable, ptrTable, objTable)
+}
+
+func encodeUnknown(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	switch e.Unknown {
+	case UndefUnknown:
+		return append(by, typeUNDEF), nil
+	case StringifyUnknown:
+		if isKeyOrClass {
+			return e.encodeString(by, fmt.Sprint(rv.Interface()), true, strTable), nil
+		}
+
+		return e.encodeStringValue(by, fmt.Sprint(rv.Interface()), false, isRefNext), nil
+	}
+
+	return nil, &UnsupportedTypeError{Type: rv.Type()}
+}
+
+func newLongDoubleEncoder(t reflect.Type, f encoderFunc) encoderFunc {
+	return func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+		if e.LongDouble == NoLongDouble {
+			return f(e, by, rv, isKeyOrClass, isRefNext, strTable, ptrTable, objTable)
+		}
+
+		if t.Kind() != reflect.Ptr {
+			x := rv.Interface().(big.Float)
+			return encodeLongDouble(by, &x, e.LongDouble), nil
+		}
+
+		if rv.IsNil() {
+			return append(by, typeUNDEF), nil
+		}
+
+		return encodeLongDouble(by, rv.Interface().(*big.Float), e.LongDouble), nil
+	}
+}
+
+func newMarshalerEncoder(t reflect.Type) encoderFunc {
+	return func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+		if t.Kind() == reflect.Ptr && rv.IsNil() {
+			return append(by, typeUNDEF), nil
+		}
+
+		v, err := rv.Interface().(Marshaler).MarshalSereal()
+		if err != nil {
+			return nil, err
+		}
+
+		return e.encode(by, v, isKeyOrClass, isRefNext, strTable, ptrTable, objTable)
 	}
+}
+
+func newBinaryMarshalerEncoder(t reflect.Type, f encoderFunc) encoderFunc {
+	return func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+		if e.DisableFREEZE {
+			return f(e, by, rv, isKeyOrClass, isRefNext, strTable, ptrTable, objTable)
+		}
+
+		b, err := rv.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		// classes may be registered after the encoder was compiled
+		class, ok := registeredClass(t)
+		if !ok {
+			class = concreteName(rv)
+		}
+
+		by = e.encodeClass(by, typeOBJECT_FREEZE, class, strTable, objTable)
+		return e.encodeFreezeValues(by, []interface{}{b}, strTable, ptrTable, objTable)
+	}
+}
+
+func newTextMarshalerEncoder(t reflect.Type, f encoderFunc) encoderFunc {
+	return func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+		if t.Kind() == reflect.Ptr && rv.IsNil() {
+			return append(by, typeUNDEF), nil
+		}
+
+		text, err := rv.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return nil, err
+		}
+
+		if isKeyOrClass {
+			return e.encodeString(by, string(text), true, strTable), nil
+		}
 
+		return e.encodeStringValue(by, string(text), false, isRefNext), nil
+	}
+}
+
+func newArrayEncoder(t reflect.Type) encoderFunc {
+	elemEnc := typeEncoder(t.Elem())
+
+	return func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+		return e.encodeArray(by, rv, elemEnc, isRefNext, strTable, ptrTable, objTable)
+	}
+}
+
+func (e *Encoder) encodeArray(by []byte, arr reflect.Value, elemEnc encoderFunc, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
 	l := arr.Len()
-	by = append(by, typeARRAY)
-	by = varint(by, uint(l))
+
+	key := containerKeyOf(arr)
+
+	if c, ok := e.state.containers[key]; ok {
+		return e.encodeSeenContainer(by, c, isRefNext), nil
+	}
+
+	e.enter()
+	defer e.leave()
+
+	start := len(by)
+	by = e.encodeArrayHeader(by, l, isRefNext)
+	e.trackContainer(by, start, key)
 
 	var err error
 	for i := 0; i < l; i++ {
-		if by, err = e.encode(by, arr.Index(i), false, false, strTable, ptrTable); err != nil {
+		if by, err = elemEnc(e, by, arr.Index(i), false, false, strTable, ptrTable, objTable); err != nil {
+			return nil, prependPath(err, "["+strconv.Itoa(i)+"]")
+		}
+
+		if by, err = e.maybeFlush(by); err != nil {
 			return nil, err
 		}
 	}
@@ -477,119 +1074,552 @@ func (e *Encoder) encodeArray(by []byte, arr reflect.Value, isRefNext bool, strT
 	return by, nil
 }
 
-func (e *Encoder) encodeMap(by []byte, m reflect.Value, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
-	if e.PerlCompat && !isRefNext {
-		by = append(by, typeREFN)
+func newMapEncoder(t reflect.Type) encoderFunc {
+	elemEnc := typeEncoder(t.Elem())
+
+	return func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+		return e.encodeMap(by, rv, elemEnc, isRefNext, strTable, ptrTable, objTable)
+	}
+}
+
+func (e *Encoder) encodeMap(by []byte, m reflect.Value, elemEnc encoderFunc, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	key := containerKeyOf(m)
+
+	if c, ok := e.state.containers[key]; ok {
+		return e.encodeSeenContainer(by, c, isRefNext), nil
 	}
 
+	e.enter()
+	defer e.leave()
+
 	keys := m.MapKeys()
-	by = append(by, typeHASH)
-	by = varint(by, uint(len(keys)))
+
+	// hash keys are always strings
+	skeys := make([]string, 0, len(keys))
+	n := 0
+	for _, k := range keys {
+		s, ok, err := e.mapKeyString(k)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			keys[n] = k
+			skeys = append(skeys, s)
+			n++
+		}
+	}
+	keys = keys[:n]
+
+	if e.Canonical {
+		sort.Sort(mapKeys{skeys, keys})
+	}
+
+	start := len(by)
+	by = e.encodeHashHeader(by, len(keys), isRefNext)
+	e.trackContainer(by, start, key)
 
 	var err error
-	if e.PerlCompat {
-		for _, k := range keys {
-			by = e.encodeString(by, k.String(), true, strTable)
-			if by, err = e.encode(by, m.MapIndex(k), false, false, strTable, ptrTable); err != nil {
-				return by, err
-			}
+	for i, k := range keys {
+		by = e.encodeString(by, skeys[i], true, strTable)
+		if by, err = elemEnc(e, by, m.MapIndex(k), false, false, strTable, ptrTable, objTable); err != nil {
+			return by, prependPath(err, "["+strconv.Quote(skeys[i])+"]")
 		}
-	} else {
-		for _, k := range keys {
-			if by, err = e.encode(by, k, true, false, strTable, ptrTable); err != nil {
-				return by, err
-			}
 
-			if by, err = e.encode(by, m.MapIndex(k), false, false, strTable, ptrTable); err != nil {
-				return by, err
-			}
+		if by, err = e.maybeFlush(by); err != nil {
+			return by, err
 		}
 	}
 
 	return by, nil
 }
 
-func (e *Encoder) encodeStruct(by []byte, st reflect.Value, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
-	tags := getStructTags(st)
+// A structEncoder encodes the fields of a struct type with their encoders
+type structEncoder struct {
+	fields   []structField
+	encoders []encoderFunc // of the fields
+	optional bool          // whether some fields may be left out
+}
+
+func newStructEncoder(t reflect.Type) encoderFunc {
+	if reflect.PtrTo(t).Implements(structMarshalerType) {
+		return func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+			m, _ := findStructMarshaler(rv)
+			return e.encodeViaStructMarshaler(by, m, strTable, ptrTable, objTable)
+		}
+	}
 
-	by = append(by, typeOBJECT)
-	by = e.encodeBytes(by, []byte(st.Type().Name()), true, strTable)
+	se := &structEncoder{}
 
-	if e.PerlCompat {
-		// must be a reference
-		by = append(by, typeREFN)
+	if fields := planFor(t).fields; fields != nil {
+		se.fields = fields.list
 	}
 
-	by = append(by, typeHASH)
-	by = varint(by, uint(len(tags)))
+	se.encoders = make([]encoderFunc, len(se.fields))
+	for i := range se.fields {
+		f := &se.fields[i]
+		se.encoders[i] = typeEncoder(t.FieldByIndex(f.index).Type)
+
+		// fields of embedded pointers are missing when they're nil
+		if f.omitEmpty || len(f.index) > 1 {
+			se.optional = true
+		}
+	}
+
+	return se.encode
+}
+
+func (se *structEncoder) encode(e *Encoder, by []byte, st reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	e.enter()
+	defer e.leave()
+
+	// omitted fields don't count towards the hash size, nor do those of nil
+	// embedded structs
+	n := len(se.fields)
+	if se.optional {
+		n = 0
+		for i := range se.fields {
+			if fv, ok := se.fields[i].field(st, false); ok && (!se.fields[i].omitEmpty || !isEmptyValue(fv)) {
+				n++
+			}
+		}
+	}
+
+	var class string
+	if !e.UnblessedStructs {
+		class = typeClass(st.Type())
+	}
 
+	by = e.encodeStructHeader(by, class, n, strTable, objTable)
+
+	// declaration order
 	var err error
-	for f, i := range tags {
-		by = e.encodeString(by, f, true, strTable)
-		if by, err = e.encode(by, st.Field(i), false, false, strTable, ptrTable); err != nil {
-			return nil, err
+	for i := range se.fields {
+		f := &se.fields[i]
+		fv, ok := f.field(st, false)
+
+		if !ok || f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+
+		if by, err = e.encodeStructField(by, f, fv, se.encoders[i], strTable, ptrTable, objTable); err != nil {
+			return nil, prependPath(err, "."+f.name)
 		}
 	}
 
 	return by, nil
 }
 
-func (e *Encoder) encodePointer(by []byte, rv reflect.Value, strTable map[string]int, ptrTable map[uintptr]int) ([]byte, error) {
+// encodeStructHeader writes the header of a struct with n fields, blessed into
+// class unless it's empty
+func (e *Encoder) encodeStructHeader(by []byte, class string, n int, strTable map[string]int, objTable map[string]int) []byte {
+	if class != "" {
+		by = e.encodeClass(by, typeOBJECT, class, strTable, objTable)
+	}
+
+	// in PerlCompat mode it must be a reference
+	return e.encodeHashHeader(by, n, false)
+}
+
+func (e *Encoder) encodeStructField(by []byte, f *structField, fv reflect.Value, enc encoderFunc, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	var err error
+
+	by = e.encodeString(by, f.name, true, strTable)
+
+	switch {
+	case f.asString:
+		by = e.encodeStringValue(by, formatStringable(fv), false, false)
+	case f.binary:
+		by = e.encodeStringValue(by, fv.String(), true, false)
+	case f.utf8:
+		by = e.encodeStringValue(by, string(fv.Bytes()), false, false)
+	default:
+		if by, err = enc(e, by, fv, false, false, strTable, ptrTable, objTable); err != nil {
+			return nil, err
+		}
+	}
+
+	return e.maybeFlush(by)
+}
+
+func newPtrEncoder(t reflect.Type) encoderFunc {
+	elemEnc := typeEncoder(t.Elem())
+
 	// ikruglov
 	// I don't fully understand this logic, so leave it as is :-)
 
-	if rv.Elem().Kind() == reflect.Struct {
-		switch rv.Elem().Interface().(type) {
-		case PerlRegexp:
-			return e.encode(by, rv.Elem(), false, false, strTable, ptrTable)
-		case PerlUndef:
-			return e.encode(by, rv.Elem(), false, false, strTable, ptrTable)
-		case PerlObject:
-			return e.encode(by, rv.Elem(), false, false, strTable, ptrTable)
-		case PerlWeakRef:
-			return e.encode(by, rv.Elem(), false, false, strTable, ptrTable)
+	if t.Elem().Kind() == reflect.Struct {
+		switch reflect.Zero(t.Elem()).Interface().(type) {
+		case PerlRegexp, PerlUndef, PerlObject, PerlWeakRef:
+			return func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+				if rv.IsNil() {
+					return e.encodePointer(by, rv, elemEnc, strTable, ptrTable, objTable)
+				}
+
+				return elemEnc(e, by, rv.Elem(), false, false, strTable, ptrTable, objTable)
+			}
+
+		case PerlFreeze:
+			return func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+				if rv.IsNil() {
+					return e.encodePointer(by, rv, elemEnc, strTable, ptrTable, objTable)
+				}
+
+				return e.encodeFreeze(by, rv.Elem().Addr().Interface().(*PerlFreeze), strTable, ptrTable, objTable)
+			}
+		}
+	}
+
+	return func(e *Encoder, by []byte, rv reflect.Value, isKeyOrClass bool, isRefNext bool, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+		return e.encodePointer(by, rv, elemEnc, strTable, ptrTable, objTable)
+	}
+}
+
+func (e *Encoder) encodePointer(by []byte, rv reflect.Value, elemEnc encoderFunc, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	if e.PerlCompat {
+		// Perl has no pointers to arrays and hashes, so a pointer to one
+		// encoded before is just another reference to it
+		if c, ok := e.state.containers[containerKeyOf(rv.Elem())]; ok {
+			return e.encodeSeenContainer(by, c, false), nil
 		}
 	}
 
 	rvptr := rv.Pointer()
 	rvptr2 := getPointer(rv.Elem())
 
+	if rvptr2 == uintptr(unsafe.Pointer(perlCanonicalUndef)) {
+		// every reference to undef has an undef of its own
+		rvptr2 = 0
+	}
+
+	// like Perl, later references point to the thing referenced rather
+	// than to this reference
+	referent := e.refersToReferent(rv.Type())
+
 	offs, ok := ptrTable[rvptr]
 
 	if !ok && rvptr2 != 0 {
 		offs, ok = ptrTable[rvptr2]
-		if ok {
-			rvptr = rvptr2
+		if ok && rv.Elem().Kind() == reflect.Ptr && referent && e.refersToReferent(rv.Elem().Type()) {
+			// a pointer to the same pointer refers to its REFN
+			offs--
 		}
 	}
 
+	e.enter()
+	defer e.leave()
+
 	if ok { // seen this before
 		by = append(by, typeREFP)
 		by = varint(by, uint(offs))
-		by[offs] |= trackFlag // original offset now tracked
+		e.setTrackFlag(by, offs) // original offset now tracked
 	} else {
 
-		lenbOrig := len(by)
+		lenbOrig := e.offset(by)
 
-		by = append(by, typeREFN)
+		if e.stream != nil {
+			// the REFN may be flushed before we know whether it's
+			// referenced again, so track it unconditionally
+			by = append(by, typeREFN|trackFlag)
+		} else {
+			by = append(by, typeREFN)
+		}
 
-		ptrTable[rvptr] = lenbOrig
+		if referent {
+			ptrTable[rvptr] = lenbOrig + 1
+		} else {
+			ptrTable[rvptr] = lenbOrig
+		}
+
+		if e.stream != nil && (rvptr2 != 0 || referent) {
+			e.stream.pending = append(e.stream.pending, lenbOrig+1)
+		}
 
 		var err error
-		by, err = e.encode(by, rv.Elem(), false, true, strTable, ptrTable)
-		if err != nil {
+		if rv.IsNil() {
+			by = append(by, typeUNDEF)
+		} else if by, err = elemEnc(e, by, rv.Elem(), false, true, strTable, ptrTable, objTable); err != nil {
 			return nil, err
 		}
 
-		if rvptr2 != 0 {
+		if rvptr2 != 0 && !(referent && rv.Elem().Kind() == reflect.Ptr) {
 			// The thing this this points to starts one after the current pointer
 			ptrTable[rvptr2] = lenbOrig + 1
 		}
+
+		if e.stream != nil && (rvptr2 != 0 || referent) {
+			by = e.stream.popPending(by)
+		}
 	}
 
 	return by, nil
 }
 
+// refersToReferent reports whether a pointer of type t is referred to via the
+// thing it points to, like Perl does.  Pointers to structs, and pointers to
+// interfaces and pointers outside PerlCompat mode, are referred to via their
+// REFN, which is where Go decoders track them.
+func (e *Encoder) refersToReferent(t reflect.Type) bool {
+	switch t.Elem().Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return e.PerlCompat
+	case reflect.Struct:
+		return false
+	}
+
+	return true
+}
+
+// prependPath adds elem to the front of the path of an *UnsupportedTypeError
+// or *DecodeError on its way up from the value it was returned for
+func prependPath(err error, elem string) error {
+	switch e := err.(type) {
+	case *UnsupportedTypeError:
+		e.Path = elem + e.Path
+	case *DecodeError:
+		e.Path = elem + e.Path
+	}
+
+	return err
+}
+
+// offset returns the position in the document body of the next byte appended to by
+func (e *Encoder) offset(by []byte) int {
+	if e.stream != nil {
+		return e.stream.base + len(by)
+	}
+
+	return len(by)
+}
+
+// setTrackFlag marks the tag at offs as tracked.  A streaming encoder tracks
+// everything that could be referenced up front, so there is nothing to do.
+func (e *Encoder) setTrackFlag(by []byte, offs int) {
+	if e.stream == nil {
+		by[offs] |= trackFlag
+	}
+}
+
+// containerKey identifies a map or slice: slices sharing their backing array
+// are only the same container if they have the same length too.  Holding on
+// to the pointer keeps containers created while encoding, e.g. by
+// MarshalSereal, from being freed and their address reused.
+type containerKey struct {
+	ptr unsafe.Pointer
+	len int
+}
+
+// containerKeyOf returns the key of the map or slice v.  Arrays are values and
+// empty slices have nothing to share, so they get the zero key.
+func containerKeyOf(v reflect.Value) containerKey {
+	switch v.Kind() {
+	case reflect.Map:
+		return containerKey{unsafe.Pointer(v.Pointer()), v.Len()}
+	case reflect.Slice:
+		if v.Len() > 0 {
+			return containerKey{unsafe.Pointer(v.Pointer()), v.Len()}
+		}
+	}
+
+	return containerKey{}
+}
+
+// container is a map or slice that has already been encoded
+type container struct {
+	offs  int  // offset of its tag
+	isRef bool // written as ARRAYREF/HASHREF, rather than REFN+ARRAY/HASH
+}
+
+// encodeState holds the tables and buffer used to encode a document.  States
+// are pooled, so encoding doesn't have to allocate them for every document.
+type encodeState struct {
+	session Encoder
+
+	strTable   map[string]int
+	ptrTable   map[uintptr]int
+	objTable   map[string]int
+	containers map[containerKey]container
+	strValues  map[strValueKey]int
+	aliases    map[*PerlAlias]int
+	writer     Writer
+
+	buf     []byte
+	avgSize int // moving average of the length of buf after encoding
+}
+
+// maxPooledBuffer is the capacity above which a buffer is only kept if recent
+// documents have needed most of it
+const maxPooledBuffer = 64 * 1024
+
+var encodeStatePool = sync.Pool{
+	New: func() interface{} {
+		return &encodeState{
+			strTable: make(map[string]int),
+			ptrTable: make(map[uintptr]int),
+			objTable: make(map[string]int),
+		}
+	},
+}
+
+// newSession returns a copy of e to encode a single document with, so e
+// itself is never modified and may be used concurrently.  The session must be
+// released once the encoded data has been copied out of its buffer.
+func (e *Encoder) newSession() *Encoder {
+	st := encodeStatePool.Get().(*encodeState)
+
+	if st.buf == nil {
+		size := int(e.ExpectedSize)
+		if st.avgSize > size {
+			size = st.avgSize
+		}
+		st.buf = make([]byte, 0, size)
+	}
+
+	st.session = *e
+	se := &st.session
+	se.stream = nil
+	se.depth = 0
+	se.state = st
+	return se
+}
+
+// release resets the tables of the session and returns its state to the pool
+func (e *Encoder) release() {
+	st := e.state
+
+	st.avgSize += (len(st.buf) - st.avgSize) / 8
+	if cap(st.buf) > maxPooledBuffer && cap(st.buf) > 2*st.avgSize {
+		// let the next document start with a buffer of the recent size
+		st.buf = nil
+	} else {
+		st.buf = st.buf[:0]
+	}
+
+	// don't keep the encoded values alive
+	for k := range st.strTable {
+		delete(st.strTable, k)
+	}
+	for k := range st.ptrTable {
+		delete(st.ptrTable, k)
+	}
+	for k := range st.objTable {
+		delete(st.objTable, k)
+	}
+	for k := range st.containers {
+		delete(st.containers, k)
+	}
+	for k := range st.strValues {
+		delete(st.strValues, k)
+	}
+	for k := range st.aliases {
+		delete(st.aliases, k)
+	}
+
+	st.writer = Writer{}
+	st.session = Encoder{}
+	encodeStatePool.Put(st)
+}
+
+// enter is called when descending into a container or pointer
+func (e *Encoder) enter() {
+	e.depth++
+	if e.MaxDepth > 0 && e.depth > e.MaxDepth {
+		panic(ErrMaxDepth)
+	}
+}
+
+func (e *Encoder) leave() {
+	e.depth--
+}
+
+// trackContainer remembers the container whose header was written at by[start:]
+func (e *Encoder) trackContainer(by []byte, start int, key containerKey) {
+	if key.ptr == nil {
+		return
+	}
+
+	if e.state.containers == nil {
+		e.state.containers = make(map[containerKey]container)
+	}
+
+	tag := by[start]
+	if tag == typeREFN {
+		start++
+	}
+
+	if e.stream != nil {
+		// no going back once it's flushed
+		by[start] |= trackFlag
+	}
+
+	e.state.containers[key] = container{e.offset(by[:start]), tag != typeREFN && tag != typeARRAY && tag != typeHASH}
+}
+
+// encodeSeenContainer writes a reference to a container encoded before.  Go
+// values are aliased, as maps and slices are references already.  In
+// PerlCompat mode a new reference is created, unless the container can only
+// be referred to via its ARRAYREF/HASHREF tag.
+func (e *Encoder) encodeSeenContainer(by []byte, c container, isRefNext bool) []byte {
+	if e.PerlCompat && !isRefNext && !c.isRef {
+		by = append(by, typeREFP)
+	} else {
+		by = append(by, typeALIAS)
+	}
+
+	by = varint(by, uint(c.offs))
+	e.setTrackFlag(by, c.offs)
+
+	return by
+}
+
+// mapKeys sorts map keys by their string form
+type mapKeys struct {
+	strs []string
+	keys []reflect.Value
+}
+
+func (m mapKeys) Len() int           { return len(m.strs) }
+func (m mapKeys) Less(i, j int) bool { return m.strs[i] < m.strs[j] }
+func (m mapKeys) Swap(i, j int) {
+	m.strs[i], m.strs[j] = m.strs[j], m.strs[i]
+	m.keys[i], m.keys[j] = m.keys[j], m.keys[i]
+}
+
+// mapKeyString returns the hash key for the map key k.  Like encoding/json,
+// strings are used as is, encoding.TextMarshaler keys are marshalled and
+// numeric and boolean keys formatted.  Other keys are up to the Unknown
+// policy; as a hash key can't be undef, ok is false for entries to leave out.
+func (e *Encoder) mapKeyString(k reflect.Value) (s string, ok bool, err error) {
+	for k.Kind() == reflect.Interface && !k.IsNil() {
+		k = k.Elem()
+	}
+
+	if k.Kind() == reflect.String {
+		return k.String(), true, nil
+	}
+
+	if m, ok := k.Interface().(encoding.TextMarshaler); ok && !(k.Kind() == reflect.Ptr && k.IsNil()) {
+		text, err := m.MarshalText()
+		if err != nil {
+			return "", false, err
+		}
+		return string(text), true, nil
+	}
+
+	if isStringable(k.Kind()) {
+		return formatStringable(k), true, nil
+	}
+
+	switch e.Unknown {
+	case UndefUnknown:
+		return "", false, nil
+	case StringifyUnknown:
+		return fmt.Sprint(k.Interface()), true, nil
+	}
+
+	return "", false, &UnsupportedTypeError{Type: k.Type()}
+}
+
 func varint(by []byte, n uint) []uint8 {
 	for n >= 0x80 {
 		b := byte(n) | 0x80
@@ -600,6 +1630,17 @@ func varint(by []byte, n uint) []uint8 {
 	return append(by, byte(n))
 }
 
+// varintLen returns the number of bytes varint uses to encode n
+func varintLen(n uint) int {
+	l := 1
+	for n >= 0x80 {
+		n >>= 7
+		l++
+	}
+
+	return l
+}
+
 func getPointer(rv reflect.Value) uintptr {
 	var rvptr uintptr
 
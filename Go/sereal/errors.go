@@ -1,6 +1,11 @@
 package sereal
 
-import "errors"
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+)
 
 var (
 	ErrBadHeaderUTF8 = errors.New("bad header: it seems your document was accidentally UTF-8 encoded")
@@ -10,9 +15,30 @@ var (
 
 	ErrHeaderPointer = errors.New("expected pointer for header")
 	ErrBodyPointer   = errors.New("expected pointer for body")
+	ErrValuePointer  = errors.New("expected pointer for value")
+
+	ErrMaxDepth = errors.New("maximum nesting depth exceeded")
+
+	ErrTruncated    = errors.New("truncated document")
+	ErrUnknownTag   = errors.New("unknown tag byte")
+	ErrTypeMismatch = errors.New("value doesn't fit the type decoded into")
+
+	ErrLongDoublePrecision = errors.New("LONG_DOUBLE value doesn't fit a float64 exactly")
+	ErrLongDoubleNaN       = errors.New("LONG_DOUBLE NaN doesn't fit a big.Float")
+
+	// The limits of a Decoder, which *LimitErrors exceeding them match
+	// via errors.Is
+	ErrMaxRecursionDepth   = &LimitError{Limit: "MaxRecursionDepth"}
+	ErrMaxStringLength     = &LimitError{Limit: "MaxStringLength"}
+	ErrMaxNumArrayEntries  = &LimitError{Limit: "MaxNumArrayEntries"}
+	ErrMaxNumHashEntries   = &LimitError{Limit: "MaxNumHashEntries"}
+	ErrMaxUncompressedSize = &LimitError{Limit: "MaxUncompressedSize"}
+	ErrMaxDocumentSize     = &LimitError{Limit: "MaxDocumentSize"}
 
-	ErrTruncated  = errors.New("truncated document")
-	ErrUnknownTag = errors.New("unknown tag byte")
+	ErrRefusedObject = errors.New("object refused by the decoder")
+	ErrRefusedFreeze = errors.New("frozen object refused by the decoder")
+	ErrRefusedSnappy = errors.New("snappy compressed document refused by the decoder")
+	ErrRefusedZlib   = errors.New("zlib compressed document refused by the decoder")
 
 	// internal constants used for corrupt
 	errBadSliceSize         = "bad size for slice"
@@ -23,8 +49,105 @@ var (
 	errStringish            = "expected stringish for classname"
 	errUntrackedOffsetAlias = "untracked offset for alias"
 	errNestedCOPY           = "bad nested copy tag"
+	errBadVarint            = "bad varint"
+	errBadFreeze            = "FREEZE values not in an array reference"
+	errBadUncompressedSize  = "bad uncompressed size"
 )
 
 type ErrCorrupt struct{ Err string }
 
-func (c ErrCorrupt) Error() string { return "sereal: corrupt document" }
+func (c ErrCorrupt) Error() string {
+	if c.Err == "" {
+		return "sereal: corrupt document"
+	}
+
+	return "sereal: corrupt document: " + c.Err
+}
+
+// A DecodeError is returned when the decoder finds a corrupt document, or a
+// value that doesn't fit the Go type it's decoded into.  Err is ErrCorrupt,
+// ErrUnknownTag or ErrTypeMismatch.  Offset is the position of the value's tag
+// in the document body, Type the type it was decoded into, and Path locates
+// it in the document, such as .planets[3].mass_earths for the mass_earths
+// entry of the fourth element of the planets entry.
+//
+// Truncated documents, exceeded limits and refused values fail with their
+// own errors instead.
+type DecodeError struct {
+	Offset int
+	Tag    byte
+	Type   reflect.Type
+	Path   string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	s := e.Err.Error()
+	if !strings.HasPrefix(s, "sereal: ") {
+		s = "sereal: " + s
+	}
+
+	if e.Path != "" {
+		s += " at " + e.Path
+	}
+
+	s += " (offset " + strconv.Itoa(e.Offset) + ", tag 0x" + strconv.FormatUint(uint64(e.Tag), 16)
+	if e.Type != nil {
+		s += ", decoding into " + e.Type.String()
+	}
+
+	return s + ")"
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// A LimitError is returned when a document exceeds one of the limits set on
+// the Decoder.  Limit is the name of the Decoder field, such as
+// MaxStringLength, and Size what the document asked for.
+type LimitError struct {
+	Limit string
+	Max   int
+	Size  int
+}
+
+func (e *LimitError) Error() string {
+	if e.Max == 0 && e.Size == 0 {
+		return "sereal: " + e.Limit + " exceeded"
+	}
+
+	return "sereal: " + e.Limit + " of " + strconv.Itoa(e.Max) + " exceeded: " + strconv.Itoa(e.Size)
+}
+
+// Is reports whether target is a *LimitError for the same limit, such as
+// ErrMaxStringLength
+func (e *LimitError) Is(target error) bool {
+	t, ok := target.(*LimitError)
+	return ok && t.Limit == e.Limit
+}
+
+// checkLimit returns a *LimitError like limit if size exceeds max, unless max
+// is 0
+func checkLimit(limit *LimitError, max int, size int) error {
+	if max > 0 && size > max {
+		return &LimitError{Limit: limit.Limit, Max: max, Size: size}
+	}
+	return nil
+}
+
+// An UnsupportedTypeError is returned when encoding a value of a type Sereal
+// has no representation for, unless the encoder's Unknown policy says
+// otherwise.  Path locates the value in the document, such as
+// .Params["query"][0] for the first element of the "query" entry of the field
+// named Params.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+	Path string
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Path == "" {
+		return "sereal: unsupported type " + e.Type.String()
+	}
+
+	return "sereal: unsupported type " + e.Type.String() + " at " + e.Path
+}
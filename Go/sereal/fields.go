@@ -0,0 +1,351 @@
+package sereal
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// structField describes how a struct field maps to a hash entry.
+//
+// Fields are named by their `sereal:"name,opts..."` tag, or by their Go name
+// when untagged.  A tag of "-" skips the field.  Options are:
+//
+//	omitempty  leave the field out if it holds the zero value of its type
+//	string     encode a numeric or boolean field as a string
+//	binary     encode a string field as BINARY instead of STR_UTF8
+//	utf8       encode a []byte field as STR_UTF8 instead of BINARY
+//
+// As with encoding/json, the fields of untagged embedded structs are promoted
+// into the hash of the outer struct.  When several fields have the same name,
+// the shallowest one wins, then the one with a tag; any others are left out.
+type structField struct {
+	name      string
+	index     []int // via embedded structs
+	tagged    bool
+	omitEmpty bool
+	asString  bool
+	binary    bool
+	utf8      bool
+
+	plan *decodePlan // of the field's type
+}
+
+// field returns the field f of the struct st.  A field promoted through a nil
+// embedded pointer is allocated if alloc is set, and missing otherwise.
+func (f *structField) field(st reflect.Value, alloc bool) (reflect.Value, bool) {
+	v := st
+	for _, i := range f.index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+
+	return v, true
+}
+
+// structFields holds the fields of a struct type in declaration order
+type structFields struct {
+	list   []structField
+	byName map[string]int // index into list
+}
+
+// lookup finds the field for a hash key, falling back to the title-cased key.
+// Structs without fields have nil structFields.
+func (sf *structFields) lookup(key string) (*structField, bool) {
+	if sf == nil {
+		return nil, false
+	}
+
+	if i, ok := sf.byName[key]; ok {
+		return &sf.list[i], true
+	}
+
+	if i, ok := sf.byName[strings.Title(key)]; ok {
+		return &sf.list[i], true
+	}
+
+	return nil, false
+}
+
+// getStructFields returns the fields of the struct ptr, or nil if ptr isn't a
+// struct or has no fields to encode or decode
+func getStructFields(ptr reflect.Value) *structFields {
+	if ptr.Kind() != reflect.Struct {
+		return nil
+	}
+
+	return planFor(ptr.Type()).fields
+}
+
+// newStructFields returns the fields of the struct type t, or nil if it has
+// none to encode or decode
+func newStructFields(t reflect.Type) *structFields {
+	sf := &structFields{list: typeFields(t), byName: make(map[string]int)}
+	if len(sf.list) == 0 {
+		return nil
+	}
+
+	for i := range sf.list {
+		sf.byName[sf.list[i].name] = i
+	}
+
+	return sf
+}
+
+// typeFields returns the fields of the struct type t, including those promoted
+// from embedded structs, following encoding/json
+func typeFields(t reflect.Type) []structField {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+
+	var fields []structField
+
+	// breadth first, so shallower fields come first
+	next := []embedded{{typ: t}}
+	visited := make(map[reflect.Type]bool)
+
+	for len(next) > 0 {
+		current := next
+		next = nil
+
+		count := make(map[reflect.Type]int)
+		for _, em := range current {
+			count[em.typ]++
+		}
+
+		for _, em := range current {
+			if visited[em.typ] {
+				continue
+			}
+			visited[em.typ] = true
+
+			l := em.typ.NumField()
+			for i := 0; i < l; i++ {
+				field := em.typ.Field(i)
+
+				ft := field.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+
+				if field.PkgPath != "" { // unexported
+					// the fields of embedded structs are still promoted, but
+					// a pointer to one can't be allocated when decoding
+					if !field.Anonymous || ft.Kind() != reflect.Struct || field.Type.Kind() == reflect.Ptr {
+						continue
+					}
+				}
+
+				tag := field.Tag.Get("sereal")
+				if tag == "-" {
+					continue
+				}
+
+				index := make([]int, len(em.index)+1)
+				copy(index, em.index)
+				index[len(em.index)] = i
+
+				opts := strings.Split(tag, ",")
+
+				if opts[0] == "" && field.Anonymous && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{ft, index})
+					continue
+				}
+
+				if field.PkgPath != "" {
+					// an unexported embedded struct with a name
+					continue
+				}
+
+				f := structField{name: field.Name, index: index}
+
+				if opts[0] != "" {
+					f.name = opts[0]
+					f.tagged = true
+				}
+
+				for _, opt := range opts[1:] {
+					switch opt {
+					case "omitempty":
+						f.omitEmpty = true
+					case "string":
+						f.asString = isStringable(field.Type.Kind())
+					case "binary":
+						f.binary = field.Type.Kind() == reflect.String
+					case "utf8":
+						f.utf8 = isByteSlice(field.Type)
+					}
+				}
+
+				fields = append(fields, f)
+				if count[em.typ] > 1 {
+					// embedded more than once at this depth, so ambiguous
+					fields = append(fields, f)
+				}
+			}
+		}
+	}
+
+	// group the fields by name, the dominant one first
+	sort.SliceStable(fields, func(i, j int) bool {
+		x, y := &fields[i], &fields[j]
+		if x.name != y.name {
+			return x.name < y.name
+		}
+		if len(x.index) != len(y.index) {
+			return len(x.index) < len(y.index)
+		}
+		return x.tagged && !y.tagged
+	})
+
+	out := fields[:0]
+	for i := 0; i < len(fields); {
+		j := i + 1
+		for j < len(fields) && fields[j].name == fields[i].name {
+			j++
+		}
+
+		// a tie between the shallowest fields hides all of them
+		if j == i+1 || len(fields[i+1].index) > len(fields[i].index) || fields[i].tagged && !fields[i+1].tagged {
+			out = append(out, fields[i])
+		}
+
+		i = j
+	}
+
+	// back to declaration order
+	sort.Slice(out, func(i, j int) bool {
+		x, y := out[i].index, out[j].index
+		for k := 0; k < len(x) && k < len(y); k++ {
+			if x[k] != y[k] {
+				return x[k] < y[k]
+			}
+		}
+		return len(x) < len(y)
+	})
+
+	return out
+}
+
+func isStringable(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+
+	return false
+}
+
+func isByteSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8
+}
+
+// isEmptyValue reports whether v is the zero value for omitempty purposes,
+// following encoding/json
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+
+	return false
+}
+
+// formatStringable returns the string form of a field with the string option.
+// Booleans use Perl's notion of true and false.
+func formatStringable(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return "1"
+		}
+		return ""
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 32)
+	default:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	}
+}
+
+// setStringable stores the decoded value val into a field with the string
+// option.  Strings are parsed, anything else is converted if possible.
+func setStringable(field reflect.Value, val reflect.Value) error {
+	for val.Kind() == reflect.Interface && !val.IsNil() {
+		val = val.Elem()
+	}
+
+	var s string
+
+	switch {
+	case val.Kind() == reflect.Interface:
+		// undef
+		return nil
+	case val.Kind() == reflect.String:
+		s = val.String()
+	case isByteSlice(val.Type()):
+		s = string(val.Bytes())
+	case val.Type().ConvertibleTo(field.Type()):
+		field.Set(val.Convert(field.Type()))
+		return nil
+	default:
+		return ErrTypeMismatch
+	}
+
+	var err error
+
+	switch field.Kind() {
+	case reflect.Bool:
+		var b bool
+		if s != "" {
+			b, err = strconv.ParseBool(s)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		i, err = strconv.ParseInt(s, 10, field.Type().Bits())
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		u, err = strconv.ParseUint(s, 10, field.Type().Bits())
+		field.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(s, field.Type().Bits())
+		field.SetFloat(f)
+	}
+
+	if err != nil {
+		// the string doesn't hold a value of the field's type
+		return ErrTypeMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,258 @@
+//go:build go1.18
+// +build go1.18
+
+package sereal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fuzzSeeds returns the documents fuzzing starts from: the round trip values
+// in every version and compression, and the Perl corpus if it was generated
+func fuzzSeeds(f *testing.F) [][]byte {
+	encoders := []*Encoder{
+		{version: 1},
+		{version: 1, Compression: SnappyCompressor{Incremental: false}},
+		{version: 2, PerlCompat: true, Compact: true},
+		{version: 2, Compression: SnappyCompressor{Incremental: true}},
+		NewEncoderV3(),
+		{version: 3, PerlCompat: true, DedupeStrings: true},
+		{version: 3, Compression: ZlibCompressor{}},
+	}
+
+	var seeds [][]byte
+	for _, e := range encoders {
+		e.CompressionThreshold = 0
+		for _, v := range roundtrips {
+			b, err := e.Marshal(v)
+			if err != nil {
+				f.Fatalf("marshalling %#v generated an error: %v", v, err)
+			}
+			seeds = append(seeds, b)
+		}
+	}
+
+	files, _ := filepath.Glob("test_dir/test_data_?????")
+	for _, file := range files {
+		if b, err := ioutil.ReadFile(file); err == nil {
+			seeds = append(seeds, b)
+		}
+	}
+
+	return seeds
+}
+
+type fuzzStruct struct {
+	Name   string
+	Count  int
+	Ratio  float64
+	Flag   bool
+	Tags   []string
+	Attrs  map[string]int
+	Raw    []byte
+	Any    interface{}
+	Next   *fuzzStruct
+	When   time.Time
+	Number int `sereal:",string"`
+}
+
+// fuzzHash decodes itself through Value, as generated code does
+type fuzzHash struct {
+	Name  string
+	Count int64
+	Next  *fuzzHash
+}
+
+func (h *fuzzHash) UnmarshalSereal(v Value) error {
+	return v.DecodeHash(func(key string, v Value) error {
+		switch key {
+		case "Name":
+			return v.DecodeString(&h.Name)
+		case "Count":
+			return v.DecodeInt(&h.Count)
+		case "Next":
+			return v.Decode(&h.Next)
+		}
+		return nil
+	})
+}
+
+// nestedHash returns depth fuzzHashes, each the Next of the one before
+func nestedHash(depth int) *fuzzHash {
+	var h *fuzzHash
+	for i := 0; i < depth; i++ {
+		h = &fuzzHash{Name: "level", Count: int64(i), Next: h}
+	}
+	return h
+}
+
+func BenchmarkDecodeNestedHash(b *testing.B) {
+	for _, depth := range []int{10, 100, 1000} {
+		doc, err := Marshal(nestedHash(depth))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(strconv.Itoa(depth), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var h fuzzHash
+				if err := Unmarshal(doc, &h); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func FuzzDecoder(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+
+	// for fuzzHash, which each level of decodes through Value
+	deep, err := Marshal(nestedHash(1000))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(deep)
+
+	decoders := []*Decoder{
+		{},
+		{PerlCompat: true},
+		{NoBlessObjects: true},
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, d := range decoders {
+			// decompression reuses the buffer
+			var v interface{}
+			d.Unmarshal(append([]byte(nil), data...), &v)
+
+			var s fuzzStruct
+			d.Unmarshal(append([]byte(nil), data...), &s)
+
+			var m map[int]*fuzzStruct
+			d.Unmarshal(append([]byte(nil), data...), &m)
+
+			var h []fuzzHash
+			d.Unmarshal(append([]byte(nil), data...), &h)
+		}
+	})
+}
+
+func FuzzMerger(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		mergers := []*Merger{
+			NewMerger(),
+			{TopLevelElement: TopLevelArray, KeepFlat: true, DedupeStrings: true},
+			{TopLevelElement: TopLevelArrayRef, KeepFlat: true, Compression: SnappyCompressor{Incremental: true}},
+		}
+
+		for _, m := range mergers {
+			if _, err := m.Append(append([]byte(nil), data...)); err != nil {
+				continue
+			}
+
+			// twice, for the tables built from the first document
+			if _, err := m.Append(append([]byte(nil), data...)); err != nil {
+				continue
+			}
+
+			b, err := m.Finish()
+			if err != nil {
+				continue
+			}
+
+			var v interface{}
+			Unmarshal(b, &v)
+		}
+	})
+}
+
+func FuzzHeader(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		readHeader(data)
+		documentLength(data)
+
+		var header interface{}
+		NewDecoder().UnmarshalHeader(append([]byte(nil), data...), &header)
+
+		d := NewDecoder()
+		d.UnmarshalAt(append([]byte(nil), data...), 0, &header, nil)
+	})
+}
+
+func FuzzStreamDecoder(f *testing.F) {
+	seeds := fuzzSeeds(f)
+	for i, seed := range seeds {
+		// two documents, so the stream has to move on to the next one
+		f.Add(append(append([]byte(nil), seed...), seeds[(i+1)%len(seeds)]...))
+	}
+
+	// a stream claiming a huge document
+	f.Add([]byte{0x3d, 0xf3, 0x72, 0x6c, 3, 0x80, 0x80, 0x80, 0x80, 0x04})
+
+	limited := Decoder{
+		MaxRecursionDepth:   100,
+		MaxNumHashEntries:   1 << 12,
+		MaxNumArrayEntries:  1 << 12,
+		MaxStringLength:     1 << 12,
+		MaxUncompressedSize: 1 << 16,
+		MaxDocumentSize:     1 << 16,
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) > 1<<16 {
+			return
+		}
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		// a byte at a time too, for refilling the buffer in the middle of a document
+		for _, s := range []*StreamDecoder{
+			NewStreamDecoder(bytes.NewReader(data)),
+			NewStreamDecoder(&oneByteReader{bytes.NewReader(data)}),
+		} {
+			s.Decoder = limited
+			for i := 0; i < 10; i++ {
+				var header, body interface{}
+				if err := s.Decode(&header, &body); err == io.EOF || err == ErrTruncated {
+					break
+				}
+			}
+		}
+
+		for offset := 0; offset < len(data); {
+			var header, body interface{}
+			consumed, _ := limited.UnmarshalAt(data, offset, &header, &body)
+			if consumed == 0 {
+				break
+			}
+			offset += consumed
+		}
+
+		runtime.ReadMemStats(&after)
+
+		// the limits bound every document, however large it claims to be
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<26 {
+			t.Errorf("decoding %d bytes allocated %d bytes", len(data), allocated)
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package sereal
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+	"reflect"
+)
+
+// A LongDoubleFormat is the layout of the 16 bytes of a LONG_DOUBLE.  Perl
+// writes its native long double, so the format depends on the platform the
+// document is meant for.
+type LongDoubleFormat int
+
+const (
+	NoLongDouble   LongDoubleFormat = iota // don't write LONG_DOUBLE tags
+	LongDoubleX87                          // x86 80 bit extended precision, zero padded
+	LongDoubleQuad                         // IEEE 754 quadruple precision
+)
+
+var bigFloatType = reflect.TypeOf((*big.Float)(nil))
+
+const longDoubleBias = 16383
+
+// precision of the formats, including the integer bit of the mantissa
+func (format LongDoubleFormat) prec() uint {
+	if format == LongDoubleX87 {
+		return 64
+	}
+
+	return 113
+}
+
+// longDoubleFormat guesses the format of the LONG_DOUBLE b: Perl zeroes the
+// padding of x86 extended precision values, where quadruple precision values
+// keep their exponent
+func longDoubleFormat(b []byte) LongDoubleFormat {
+	for _, c := range b[10:16] {
+		if c != 0 {
+			return LongDoubleQuad
+		}
+	}
+
+	return LongDoubleX87
+}
+
+// decodeLongDouble returns the exact value of the LONG_DOUBLE b, or nan
+func decodeLongDouble(b []byte) (f *big.Float, nan bool) {
+	format := longDoubleFormat(b)
+
+	lo := binary.LittleEndian.Uint64(b)
+	hi := binary.LittleEndian.Uint64(b[8:])
+
+	var se uint64 // sign and exponent
+	mant := new(big.Int)
+
+	if format == LongDoubleX87 {
+		se = hi & 0xffff
+		mant.SetUint64(lo)
+	} else {
+		se = hi >> 48
+		mant.SetUint64(hi & (1<<48 - 1))
+		mant.Lsh(mant, 64)
+		mant.Or(mant, new(big.Int).SetUint64(lo))
+	}
+
+	exp := int(se & 0x7fff)
+	f = new(big.Float).SetPrec(format.prec())
+
+	switch {
+	case exp == 0x7fff:
+		// the x87 integer bit is set for infinities too
+		if format == LongDoubleX87 {
+			mant.SetBit(mant, 63, 0)
+		}
+		if mant.Sign() != 0 {
+			return nil, true
+		}
+		f.SetInf(se&0x8000 != 0)
+		return f, false
+
+	case exp == 0:
+		// subnormal
+		exp = 1
+
+	case format == LongDoubleQuad:
+		mant.SetBit(mant, 112, 1)
+	}
+
+	f.SetInt(mant)
+	f.SetMantExp(f, exp-longDoubleBias-int(format.prec()-1))
+
+	if se&0x8000 != 0 {
+		f.Neg(f)
+	}
+
+	return f, false
+}
+
+// encodeLongDouble appends f as a LONG_DOUBLE in the given format, rounded to
+// its precision
+func encodeLongDouble(by []byte, f *big.Float, format LongDoubleFormat) []byte {
+	prec := format.prec()
+
+	var se uint64
+	if f.Signbit() {
+		se = 0x8000
+	}
+
+	mant := new(big.Int)
+	exp := 0
+
+	switch {
+	case f.IsInf():
+		exp = 0x7fff
+		if format == LongDoubleX87 {
+			mant.SetBit(mant, 63, 1)
+		}
+
+	case f.Sign() != 0:
+		a := new(big.Float).SetPrec(prec).Abs(f)
+		exp = a.MantExp(nil) - 1 + longDoubleBias
+
+		switch {
+		case exp >= 0x7fff:
+			// too large
+			exp = 0x7fff
+			if format == LongDoubleX87 {
+				mant.SetBit(mant, 63, 1)
+			}
+
+		case exp <= 0:
+			// subnormal: round to a multiple of the smallest one by
+			// adding the smallest normal number, which has one
+			a.SetPrec(0).Set(f).Abs(a)
+			a.SetMantExp(a, longDoubleBias-1+int(prec-1))
+
+			normal := new(big.Float).SetMantExp(big.NewFloat(1), int(prec-1))
+			a = new(big.Float).SetPrec(prec).Add(a, normal)
+			a.Sub(a, normal)
+			a.Int(mant)
+
+			exp = 0
+			if mant.BitLen() == int(prec) {
+				// rounded up to the smallest normal number
+				exp = 1
+			}
+
+		default:
+			a.SetMantExp(a, int(prec)-a.MantExp(nil))
+			a.Int(mant)
+		}
+
+		if format == LongDoubleQuad {
+			mant.SetBit(mant, 112, 0)
+		}
+	}
+
+	se |= uint64(exp)
+
+	var lo, hi uint64
+	if format == LongDoubleX87 {
+		lo = mant.Uint64()
+		hi = se
+	} else {
+		lo = new(big.Int).And(mant, new(big.Int).SetUint64(1<<64-1)).Uint64()
+		hi = se<<48 | new(big.Int).Rsh(mant, 64).Uint64()
+	}
+
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], lo)
+	binary.LittleEndian.PutUint64(b[8:], hi)
+
+	by = append(by, typeLONG_DOUBLE)
+	return append(by, b[:]...)
+}
+
+// setLongDouble sets v to the LONG_DOUBLE b, which fits a big.Float exactly,
+// but a float64 only if strict isn't set or it has no more precision
+func setLongDouble(v reflect.Value, b []byte, strict bool) error {
+	f, nan := decodeLongDouble(b)
+
+	switch v.Type() {
+	case bigFloatType, bigFloatType.Elem():
+		if nan {
+			return ErrLongDoubleNaN
+		}
+
+		if v.Kind() == reflect.Ptr {
+			v.Set(reflect.ValueOf(f))
+		} else {
+			v.Set(reflect.ValueOf(f).Elem())
+		}
+		return nil
+	}
+
+	if nan {
+		return setFloat(v, reflect.Float64, math.NaN())
+	}
+
+	x, acc := f.Float64()
+	if strict && acc != big.Exact {
+		return ErrLongDoublePrecision
+	}
+
+	return setFloat(v, reflect.Float64, x)
+}
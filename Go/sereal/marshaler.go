@@ -0,0 +1,438 @@
+package sereal
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"runtime"
+)
+
+// Marshaler is the interface implemented by types that replace themselves
+// with another value when encoded.  The returned value is encoded in their
+// place, so a type can be sent as an ordinary Sereal structure that Perl
+// understands, e.g. a UUID as a string or an amount of money as a hash.
+type Marshaler interface {
+	MarshalSereal() (interface{}, error)
+}
+
+// Unmarshaler is the interface implemented by types that decode themselves
+// from the Sereal value in the document, typically one produced by their
+// MarshalSereal method.
+type Unmarshaler interface {
+	UnmarshalSereal(Value) error
+}
+
+// Value is an encoded value passed to UnmarshalSereal.  It is only valid for
+// the duration of the call.
+//
+// Besides Decode, which decodes any value via reflection, Value has methods
+// decoding plain scalars and struct fields directly, for use by code generated
+// by cmd/serealgen.  They fall back to Decode for anything else.
+type Value struct {
+	d      *Decoder
+	b      []byte
+	idx    int
+	st     *decodeState
+	target reflect.Value // what the value is decoded into, if known
+
+	// the fields of the struct whose hash entry key the value is, if known
+	fields *structFields
+	key    string
+}
+
+// recoverError turns a panic of the decoder into an error
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		if _, ok := r.(runtime.Error); ok {
+			panic(r)
+		}
+
+		if s, ok := r.(string); ok {
+			*err = errors.New(s)
+		} else {
+			*err = r.(error)
+		}
+	}
+}
+
+// Decode decodes the value into the value pointed to by ptr
+func (v Value) Decode(ptr interface{}) (err error) {
+	defer recoverError(&err)
+
+	rv := reflect.ValueOf(ptr)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrValuePointer
+	}
+
+	sz, err := v.d.decodePlanned(v.b, v.idx, v.st, rv.Elem(), v.fieldPlan(rv.Type().Elem()))
+	if err != nil {
+		return err
+	}
+
+	v.setLength(sz)
+	return nil
+}
+
+// fieldPlan returns the decode plan of the struct field the value is an entry
+// for, if the field is of type t, so decoding into it needn't look it up
+func (v Value) fieldPlan(t reflect.Type) *decodePlan {
+	if f, ok := v.fields.lookup(v.key); ok && f.plan.typ == t {
+		return f.plan
+	}
+
+	return nil
+}
+
+var (
+	marshalerType       = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerType     = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+)
+
+// findSerealUnmarshaler returns the Unmarshaler for ptr, if it has one
+func findSerealUnmarshaler(ptr reflect.Value, plan *decodePlan) (Unmarshaler, bool) {
+	if u, ok := findImplementation(ptr, plan.unmarshaler); ok {
+		return u.(Unmarshaler), true
+	}
+
+	return nil, false
+}
+
+// findTextUnmarshaler returns the encoding.TextUnmarshaler for ptr, if it has one
+func findTextUnmarshaler(ptr reflect.Value, plan *decodePlan) (encoding.TextUnmarshaler, bool) {
+	if u, ok := findImplementation(ptr, plan.textUnmarshaler); ok {
+		return u.(encoding.TextUnmarshaler), true
+	}
+
+	return nil, false
+}
+
+// findImplementation returns ptr, or its address, if it implements an
+// interface the way impl says.  Nil pointers implementing it are allocated.
+func findImplementation(ptr reflect.Value, impl implementation) (interface{}, bool) {
+	if impl.byValue {
+		if ptr.IsNil() {
+			if !ptr.CanSet() {
+				return nil, false
+			}
+			ptr.Set(reflect.New(ptr.Type().Elem()))
+		}
+
+		return ptr.Interface(), true
+	}
+
+	if impl.byAddress && ptr.CanAddr() {
+		return ptr.Addr().Interface(), true
+	}
+
+	return nil, false
+}
+
+// tag returns the tag of the value if it can be decoded directly: not tracked,
+// which Decode takes care of
+func (v Value) tag() (byte, bool) {
+	if v.idx < 0 || v.idx >= len(v.b) {
+		return 0, false
+	}
+
+	tag := v.b[v.idx]
+	return tag, tag&trackFlag == 0
+}
+
+// setLength records that the value is sz bytes long, for valueLength
+func (v Value) setLength(sz int) {
+	v.st.setValueLength(v.idx, sz)
+}
+
+// intValue returns the integer at the start of the value, and its size
+func (v Value) intValue() (int64, int, bool) {
+	tag, ok := v.tag()
+	if !ok {
+		return 0, 0, false
+	}
+
+	switch {
+	case tag < typeVARINT:
+		i := int64(tag)
+		if tag&0x10 == 0x10 {
+			i -= 32
+		}
+		return i, 1, true
+
+	case tag == typeVARINT, tag == typeZIGZAG:
+		i, sz, err := readVarint(v.b[v.idx+1:])
+		if err != nil {
+			return 0, 0, false
+		}
+
+		if tag == typeZIGZAG {
+			i = int(-(1 + (uint64(i) >> 1))) // un-zigzag
+		}
+		return int64(i), 1 + sz, true
+	}
+
+	return 0, 0, false
+}
+
+// DecodeInt decodes an integer into *p
+func (v Value) DecodeInt(p *int64) error {
+	if i, sz, ok := v.intValue(); ok {
+		*p = i
+		v.setLength(sz)
+		return nil
+	}
+
+	return v.Decode(p)
+}
+
+// DecodeUint decodes an unsigned integer into *p
+func (v Value) DecodeUint(p *uint64) error {
+	if i, sz, ok := v.intValue(); ok {
+		*p = uint64(i)
+		v.setLength(sz)
+		return nil
+	}
+
+	return v.Decode(p)
+}
+
+// DecodeFloat decodes a floating point number into *p
+func (v Value) DecodeFloat(p *float64) error {
+	tag, ok := v.tag()
+
+	var b []byte
+	if ok {
+		b = v.b[v.idx+1:]
+	}
+
+	switch {
+	case ok && tag == typeFLOAT && len(b) >= 4:
+		*p = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		v.setLength(1 + 4)
+		return nil
+
+	case ok && tag == typeDOUBLE && len(b) >= 8:
+		*p = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		v.setLength(1 + 8)
+		return nil
+	}
+
+	return v.Decode(p)
+}
+
+// DecodeBool decodes a boolean into *p
+func (v Value) DecodeBool(p *bool) error {
+	if tag, ok := v.tag(); ok && (tag == typeTRUE || tag == typeFALSE) {
+		*p = tag == typeTRUE
+		v.setLength(1)
+		return nil
+	}
+
+	return v.Decode(p)
+}
+
+// rawString returns the contents of the string or binary at the start of the
+// value, and its size
+func (v Value) rawString() ([]byte, int, bool) {
+	tag, ok := v.tag()
+	if !ok {
+		return nil, 0, false
+	}
+
+	idx := v.idx + 1
+
+	var ln int
+	switch {
+	case tag == typeBINARY, tag == typeSTR_UTF8:
+		n, sz, err := readVarint(v.b[idx:])
+		if err != nil || n < 0 {
+			return nil, 0, false
+		}
+		ln = n
+		idx += sz
+
+	case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
+		ln = int(tag & 0x1f)
+
+	default:
+		return nil, 0, false
+	}
+
+	if ln > len(v.b)-idx {
+		return nil, 0, false
+	}
+
+	// leave strings over the limit to Decode, which fails
+	if v.d != nil && checkLimit(ErrMaxStringLength, v.d.MaxStringLength, ln) != nil {
+		return nil, 0, false
+	}
+
+	return v.b[idx : idx+ln], idx + ln - v.idx, true
+}
+
+// DecodeString decodes a string into *p
+func (v Value) DecodeString(p *string) error {
+	if s, sz, ok := v.rawString(); ok {
+		*p = string(s)
+		v.setLength(sz)
+		return nil
+	}
+
+	return v.Decode(p)
+}
+
+// DecodeBytes decodes a string into the byte slice *p
+func (v Value) DecodeBytes(p *[]byte) error {
+	if *p == nil {
+		if s, sz, ok := v.rawString(); ok {
+			*p = append(make([]byte, 0, len(s)), s...)
+			v.setLength(sz)
+			return nil
+		}
+	}
+
+	return v.Decode(p)
+}
+
+// DecodeStringOption decodes a struct field with the string option, which
+// holds its number or boolean as a string, into the value pointed to by ptr
+func (v Value) DecodeStringOption(ptr interface{}) (err error) {
+	defer recoverError(&err)
+
+	rv := reflect.ValueOf(ptr)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrValuePointer
+	}
+
+	var iface interface{}
+	val := reflect.ValueOf(&iface).Elem()
+
+	sz, err := v.d.decode(v.b, v.idx, v.st, val)
+	if err != nil {
+		return err
+	}
+
+	v.setLength(sz)
+	return setStringable(rv.Elem(), val)
+}
+
+// DecodeHash calls fn with the key and value of each entry of the hash, which
+// may be wrapped in references and objects like encoded structs are
+func (v Value) DecodeHash(fn func(key string, v Value) error) (err error) {
+	defer recoverError(&err)
+
+	b, idx, target := v.b, v.idx, v.target
+
+	var ln int
+
+LOOP:
+	for {
+		if idx < 0 || idx >= len(b) {
+			return ErrTruncated
+		}
+
+		tag := b[idx]
+		trackme := tag&trackFlag == trackFlag && target.IsValid()
+		tag &^= trackFlag
+
+		if tag == typeREFN && target.IsValid() && target.Kind() == reflect.Ptr {
+			if target.IsNil() {
+				target.Set(reflect.New(target.Type().Elem()))
+			}
+			target = target.Elem()
+		}
+
+		if trackme {
+			// for references back to what's being decoded
+			v.st.tracked[idx] = target
+		}
+
+		idx++
+
+		switch {
+		case tag == typePAD, tag == typeREFN:
+			// skip
+
+		case (tag == typeOBJECT || tag == typeOBJECTV) && v.d.RefuseObjects:
+			return ErrRefusedObject
+
+		case tag == typeOBJECT:
+			if !isStringish(b, idx) {
+				return ErrCorrupt{errStringish}
+			}
+
+			sz, err := bodyLength(b[idx:])
+			if err != nil {
+				return err
+			}
+			idx += sz
+
+		case tag == typeOBJECTV:
+			_, sz, err := readVarint(b[idx:])
+			if err != nil {
+				return err
+			}
+			idx += sz
+
+		case tag == typeHASH:
+			n, sz, err := readVarint(b[idx:])
+			if err != nil {
+				return err
+			}
+			idx += sz
+
+			if n < 0 || 2*n > len(b[idx:]) {
+				return ErrCorrupt{errBadHashSize}
+			}
+
+			ln = n
+			break LOOP
+
+		case tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+			ln = int(tag & 0x0f)
+			break LOOP
+
+		case tag == typeUNDEF, tag == typeCANONICAL_UNDEF:
+			// like the decoder, leave the target as it is
+			v.setLength(idx - v.idx)
+			return nil
+
+		default:
+			return newDecodeError(ErrTypeMismatch, b, idx-1, target)
+		}
+	}
+
+	if err := checkLimit(ErrMaxNumHashEntries, v.d.MaxNumHashEntries, ln); err != nil {
+		return err
+	}
+
+	var fields *structFields
+	if target.IsValid() {
+		fields = getStructFields(target)
+	}
+
+	for i := 0; i < ln; i++ {
+		key, sz, err := v.d.decodeKey(b, idx, v.st)
+		if err != nil {
+			return err
+		}
+		idx += sz
+
+		if err := fn(key, Value{d: v.d, b: b, idx: idx, st: v.st, fields: fields, key: key}); err != nil {
+			return prependPath(err, "."+key)
+		}
+
+		sz, err = v.st.valueLength(b, idx)
+		if err != nil {
+			return err
+		}
+		idx += sz
+	}
+
+	v.setLength(idx - v.idx)
+	return nil
+}
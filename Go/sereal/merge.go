@@ -185,7 +185,7 @@ func (m *Merger) Append(b []byte) (int, error) {
 	}
 
 	if decomp != nil {
-		if doc.buf, err = decomp.decompress(doc.buf); err != nil {
+		if doc.buf, err = decomp.decompress(doc.buf, 0); err != nil {
 			return 0, err
 		}
 	}
@@ -229,9 +229,8 @@ func (m *Merger) Finish() ([]byte, error) {
 				return m.buf, err
 			}
 
-			// TODO think about some optimizations here
-			copy(m.buf[m.bodyOffset+1:], compressed)
-			m.buf = m.buf[:len(compressed)+m.bodyOffset+1]
+			// small bodies may grow
+			m.buf = append(m.buf[:m.bodyOffset+1], compressed...)
 
 			// verify compressor, there was little point in veryfing compressor in initMerger()
 			// because use can change it meanwhile
@@ -288,7 +287,10 @@ func (m *Merger) buildTrackTable(doc *mergerDoc) error {
 			idx++
 
 		case tag == typeVARINT, tag == typeZIGZAG:
-			_, sz := varintdecode(buf[idx+1:])
+			_, sz, err := readVarint(buf[idx+1:])
+			if err != nil {
+				return err
+			}
 			idx += sz + 1
 
 		case tag == typeFLOAT:
@@ -301,7 +303,10 @@ func (m *Merger) buildTrackTable(doc *mergerDoc) error {
 			idx += 17 // 16 bytes + tag
 
 		case tag == typeBINARY, tag == typeSTR_UTF8:
-			ln, sz := varintdecode(buf[idx+1:])
+			ln, sz, err := readVarint(buf[idx+1:])
+			if err != nil {
+				return err
+			}
 			idx += sz + ln + 1
 
 			if ln < 0 || ln > maxUint32 {
@@ -311,13 +316,19 @@ func (m *Merger) buildTrackTable(doc *mergerDoc) error {
 			}
 
 		case tag == typeARRAY, tag == typeHASH:
-			_, sz := varintdecode(buf[idx+1:])
+			_, sz, err := readVarint(buf[idx+1:])
+			if err != nil {
+				return err
+			}
 			idx += sz + 1
 
 		case tag == typeCOPY, tag == typeALIAS, tag == typeREFP,
 			tag == typeOBJECTV, tag == typeOBJECTV_FREEZE:
 
-			offset, sz := varintdecode(buf[idx+1:])
+			offset, sz, err := readVarint(buf[idx+1:])
+			if err != nil {
+				return err
+			}
 			if offset < 0 || offset >= idx {
 				return fmt.Errorf("tag %d refers to invalid offset: %d", tag, offset)
 			}
@@ -356,7 +367,10 @@ func (m *Merger) mergeItems(doc *mergerDoc) error {
 	dbuf := doc.buf
 	didx := doc.startIdx
 
-	expElements, offset := m.expectedElements(dbuf[didx:])
+	expElements, offset, err := m.expectedElements(dbuf[didx:])
+	if err != nil {
+		return err
+	}
 	if expElements < 0 || expElements > maxUint32 {
 		return fmt.Errorf("bad amount of expected elements: %d", expElements)
 	}
@@ -413,23 +427,38 @@ LOOP:
 			didx++
 
 		case tag == typeVARINT, tag == typeZIGZAG:
-			_, sz := varintdecode(dbuf[didx+1:])
+			_, sz, err := readVarint(dbuf[didx+1:])
+			if err != nil {
+				return err
+			}
 			mbuf = append(mbuf, dbuf[didx:didx+sz+1]...)
 			didx += sz + 1
 
 		case tag == typeFLOAT:
+			if didx+5 > len(dbuf) {
+				return ErrTruncated
+			}
 			mbuf = append(mbuf, dbuf[didx:didx+5]...)
 			didx += 5 // 4 bytes + tag
 
 		case tag == typeDOUBLE:
+			if didx+9 > len(dbuf) {
+				return ErrTruncated
+			}
 			mbuf = append(mbuf, dbuf[didx:didx+9]...)
 			didx += 9 // 8 bytes + tag
 
 		case tag == typeLONG_DOUBLE:
+			if didx+17 > len(dbuf) {
+				return ErrTruncated
+			}
 			mbuf = append(mbuf, dbuf[didx:didx+17]...)
 			didx += 17 // 16 bytes + tag
 
 		case tag == typeSHORT_BINARY_0+1:
+			if didx+2 > len(dbuf) {
+				return ErrTruncated
+			}
 			mbuf = append(mbuf, dbuf[didx:didx+2]...)
 			didx += 2
 
@@ -441,7 +470,10 @@ LOOP:
 			if tag > typeSHORT_BINARY_0 {
 				ln = int(tag & 0x1F) // get length from tag
 			} else {
-				ln, sz = varintdecode(dbuf[didx+1:])
+				var err error
+				if ln, sz, err = readVarint(dbuf[didx+1:]); err != nil {
+					return err
+				}
 			}
 
 			length := sz + ln + 1
@@ -469,7 +501,10 @@ LOOP:
 		case tag == typeCOPY, tag == typeREFP, tag == typeALIAS,
 			tag == typeOBJECTV, tag == typeOBJECTV_FREEZE:
 
-			offset, sz := varintdecode(dbuf[didx+1:])
+			offset, sz, err := readVarint(dbuf[didx+1:])
+			if err != nil {
+				return err
+			}
 			targetOffset, ok := doc.trackTable[offset]
 
 			if !ok || targetOffset < 0 {
@@ -486,7 +521,10 @@ LOOP:
 			}
 
 		case tag == typeARRAY, tag == typeHASH:
-			ln, sz := varintdecode(dbuf[didx+1:])
+			ln, sz, err := readVarint(dbuf[didx+1:])
+			if err != nil {
+				return err
+			}
 			if ln < 0 {
 				return errors.New("bad array or hash length")
 			}
@@ -571,34 +609,45 @@ LOOP:
 		}
 	}
 
+	// the document ended before all elements it announced
+	for _, n := range stack {
+		if n&^hashKeysValuesFlag != 0 {
+			return ErrTruncated
+		}
+	}
+
 	m.length += expElements
 	m.buf = mbuf
 	return nil
 }
 
-func (m *Merger) expectedElements(b []byte) (int, int) {
-	if m.KeepFlat {
+func (m *Merger) expectedElements(b []byte) (int, int, error) {
+	if m.KeepFlat && len(b) > 0 {
 		tag0 := b[0] &^ trackFlag
-		tag1 := b[1] &^ trackFlag
+
+		var tag1 byte
+		if len(b) > 1 {
+			tag1 = b[1] &^ trackFlag
+		}
 
 		switch m.TopLevelElement {
 		case TopLevelArray:
 			if tag0 == typeARRAY {
-				ln, sz := varintdecode(b[1:])
-				return ln, sz + 1
+				ln, sz, err := readVarint(b[1:])
+				return ln, sz + 1, err
 			}
 
 		case TopLevelArrayRef:
 			if tag0 == typeREFN && tag1 == typeARRAY {
-				ln, sz := varintdecode(b[2:])
-				return ln, sz + 2
+				ln, sz, err := readVarint(b[2:])
+				return ln, sz + 2, err
 			} else if tag0 >= typeARRAYREF_0 && tag0 < typeARRAYREF_0+16 {
-				return int(tag0 & 0xF), 1
+				return int(tag0 & 0xF), 1, nil
 			}
 		}
 	}
 
-	return 1, 0 // by default expect only one element
+	return 1, 0, nil // by default expect only one element
 }
 
 func isShallowStringish(tag byte) bool {
@@ -606,6 +655,10 @@ func isShallowStringish(tag byte) bool {
 }
 
 func readString(buf []byte) (int, []byte, error) {
+	if len(buf) == 0 {
+		return 0, nil, ErrTruncated
+	}
+
 	tag := buf[0]
 	tag &^= trackFlag
 
@@ -617,7 +670,10 @@ func readString(buf []byte) (int, []byte, error) {
 	if tag > typeSHORT_BINARY_0 {
 		ln = int(tag & 0x1F) // get length from tag
 	} else {
-		ln, offset = varintdecode(buf[1:])
+		var err error
+		if ln, offset, err = readVarint(buf[1:]); err != nil {
+			return 0, nil, err
+		}
 	}
 
 	offset++ // respect tag itself
@@ -1,5 +1,11 @@
 package sereal
 
+import (
+	"encoding"
+	"reflect"
+	"sync"
+)
+
 // types for emulating perl data structure
 
 // PerlObject represents a perl blessed reference
@@ -8,7 +14,9 @@ type PerlObject struct {
 	Reference interface{}
 }
 
-// PerlAlias represents an aliased value
+// PerlAlias represents an aliased value.  In PerlCompat mode the decoder
+// shares a single *PerlAlias between a value and its aliases, which the
+// encoder writes as ALIAS tags again.
 type PerlAlias struct {
 	Alias interface{}
 }
@@ -28,6 +36,8 @@ type PerlUndef struct {
 // the canonical field set to true.
 var perlCanonicalUndef = &PerlUndef{canonical: true}
 
+var perlUndefType = reflect.TypeOf(perlCanonicalUndef)
+
 // PerlCanonicalUndef returns a value that represents perl's shared undef (PL_sv_undef).
 //
 // For more details see
@@ -42,8 +52,123 @@ type PerlRegexp struct {
 	Modifiers []byte
 }
 
-// PerlFreeze represents an object's custom Freeze implementation
+// PerlFreeze represents an object's custom Freeze implementation.  Values
+// holds the values returned by the object's FREEZE method.  Data is set when
+// there is a single string value, such as the output of MarshalBinary.  When
+// encoding, Data is used if Values is nil.
 type PerlFreeze struct {
-	Class string
-	Data  []byte
+	Class  string
+	Data   []byte
+	Values []interface{}
+}
+
+// values returns the values to encode for f
+func (f *PerlFreeze) values() []interface{} {
+	if f.Values == nil {
+		return []interface{}{f.Data}
+	}
+
+	return f.Values
+}
+
+var (
+	classLock sync.RWMutex
+
+	typeClasses = make(map[reflect.Type]string) // registered with RegisterClass
+	classTypes  = make(map[string]reflect.Type)
+	tagClasses  = make(map[reflect.Type]string) // cache for typeClass
+)
+
+var binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+
+// RegisterClass maps the Go type t to the named Perl class.  Values of type t
+// are blessed into class when encoded, instead of the class named by their
+// type.  Unless the decoder is in PerlCompat mode, objects blessed into class
+// decode into a new value of type t when decoding into an interface.  t is a
+// struct type, or a pointer to one.
+//
+// The class of a struct type can also be given by the tag of a blank field,
+// as in
+//
+//	type User struct {
+//		_    struct{} `sereal:"MyApp::Model::User"`
+//		Name string
+//	}
+//
+// but only registered classes are decoded back into their Go types.  If t
+// implements encoding.BinaryUnmarshaler, it is also registered for the FREEZE
+// tags of class as with RegisterName.
+func RegisterClass(t reflect.Type, class string) {
+	classLock.Lock()
+	typeClasses[classKey(t)] = class
+	classTypes[class] = t
+	classLock.Unlock()
+
+	registerLock.Lock()
+	defer registerLock.Unlock()
+
+	if t.Implements(binaryUnmarshalerType) {
+		nameToType[class] = t
+	} else if reflect.PtrTo(t).Implements(binaryUnmarshalerType) {
+		nameToType[class] = reflect.PtrTo(t)
+	}
+}
+
+// classKey returns the type values of t are registered under
+func classKey(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+
+	return t
+}
+
+// registeredClass returns the class registered for values of type t, if any
+func registeredClass(t reflect.Type) (string, bool) {
+	classLock.RLock()
+	defer classLock.RUnlock()
+
+	class, ok := typeClasses[classKey(t)]
+	return class, ok
+}
+
+// classType returns the type registered for class, if any
+func classType(class string) (reflect.Type, bool) {
+	classLock.RLock()
+	defer classLock.RUnlock()
+
+	t, ok := classTypes[class]
+	return t, ok
+}
+
+// typeClass returns the class values of the struct type t are blessed into:
+// the registered class, the tag of a blank field, or the name of the type.
+// Anonymous structs have no class.
+func typeClass(t reflect.Type) string {
+	classLock.RLock()
+	class, ok := typeClasses[t]
+	if !ok {
+		class, ok = tagClasses[t]
+	}
+	classLock.RUnlock()
+
+	if ok {
+		return class
+	}
+
+	class = t.Name()
+
+	l := t.NumField()
+	for i := 0; i < l; i++ {
+		if f := t.Field(i); f.Name == "_" && f.Tag.Get("sereal") != "" {
+			class = f.Tag.Get("sereal")
+			break
+		}
+	}
+
+	classLock.Lock()
+	tagClasses[t] = class
+	classLock.Unlock()
+
+	return class
 }
@@ -0,0 +1,62 @@
+package sereal
+
+import (
+	"reflect"
+	"sync"
+)
+
+// implementation tells how values of a type implement an interface
+type implementation struct {
+	byValue   bool // the type is a pointer type with the methods
+	byAddress bool // a pointer to the type has the methods
+}
+
+func implementationOf(t reflect.Type, iface reflect.Type) implementation {
+	return implementation{
+		byValue:   t.Kind() == reflect.Ptr && t.Implements(iface),
+		byAddress: t.Kind() != reflect.Interface && reflect.PtrTo(t).Implements(iface),
+	}
+}
+
+// A decodePlan is what decoding into a type needs to know about it, worked
+// out once for the type rather than for every value decoded into it
+type decodePlan struct {
+	typ             reflect.Type   // planned for
+	unmarshaler     implementation // of Unmarshaler
+	textUnmarshaler implementation // of encoding.TextUnmarshaler
+	fields          *structFields  // of a struct type with fields to decode
+}
+
+var decodePlans sync.Map // map[reflect.Type]*decodePlan
+
+// noPlan is the plan of types with nothing to plan, such as interfaces
+var noPlan = &decodePlan{}
+
+// planFor returns the decode plan of t, compiling it the first time
+func planFor(t reflect.Type) *decodePlan {
+	if p, ok := decodePlans.Load(t); ok {
+		return p.(*decodePlan)
+	}
+
+	p := &decodePlan{
+		typ:             t,
+		unmarshaler:     implementationOf(t, unmarshalerType),
+		textUnmarshaler: implementationOf(t, textUnmarshalerType),
+	}
+
+	if t.Kind() == reflect.Struct {
+		p.fields = newStructFields(t)
+
+		// structs can't contain themselves, so this ends
+		if p.fields != nil {
+			for i := range p.fields.list {
+				f := &p.fields.list[i]
+				f.plan = planFor(t.FieldByIndex(f.index).Type)
+			}
+		}
+	}
+
+	// another goroutine may have compiled the same plan meanwhile
+	actual, _ := decodePlans.LoadOrStore(t, p)
+	return actual.(*decodePlan)
+}
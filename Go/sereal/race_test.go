@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package sereal
+
+// sync.Pool drops items at random under the race detector
+const raceEnabled = true
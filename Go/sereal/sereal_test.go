@@ -4,10 +4,18 @@ import (
 	"bytes"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -153,8 +161,7 @@ func TestCorpus(t *testing.T) {
 
 	e := &Encoder{PerlCompat: true}
 	d := &Decoder{PerlCompat: true}
-
-	_ = e
+	canonical := &Encoder{PerlCompat: true, Canonical: true}
 
 	debug := false
 
@@ -212,6 +219,97 @@ func TestCorpus(t *testing.T) {
 		}
 
 		ioutil.WriteFile(corpusFile+"-go.out", b, 0600)
+
+		// what's decoded from Go's document encodes the same again, so
+		// aliases, shared references and frozen objects survived
+		x, err := canonical.Marshal(value)
+		if err != nil {
+			t.Errorf("packing %s canonically generated an error: %v", corpusFile, err)
+			continue
+		}
+
+		var again interface{}
+		if err := d.Unmarshal(append([]byte(nil), x...), &again); err != nil {
+			t.Errorf("unpacking %s from Go generated an error: %v", corpusFile, err)
+			continue
+		}
+
+		y, err := canonical.Marshal(again)
+		if err != nil {
+			t.Errorf("packing %s again generated an error: %v", corpusFile, err)
+			continue
+		}
+
+		if !bytes.Equal(x, y) {
+			t.Errorf("%s doesn't round trip:\n%x\n%x", corpusFile, x, y)
+		}
+	}
+}
+
+// TestCorpusRoundTrip is the Go side of test-compat.pl: the corpus decodes
+// the same in PerlCompat mode after being encoded by Go
+func TestCorpusRoundTrip(t *testing.T) {
+
+	corpusFiles, err := filepath.Glob("test_dir/test_data_?????")
+	if err != nil {
+		t.Fatalf("error opening test_dir: %v", err)
+	}
+
+	if len(corpusFiles) == 0 {
+		t.Skip("no corpus in test_dir, see the Makefile")
+	}
+
+	e := &Encoder{PerlCompat: true}
+	d := &Decoder{PerlCompat: true}
+	canonical := &Encoder{PerlCompat: true, Canonical: true}
+
+	for _, corpusFile := range corpusFiles {
+		name, err := ioutil.ReadFile(strings.Replace(corpusFile, "test_data_", "test_name_", 1))
+		if err != nil {
+			t.Fatalf("error opening the name of %s: %v", corpusFile, err)
+		}
+
+		contents, err := ioutil.ReadFile(corpusFile)
+		if err != nil {
+			t.Fatalf("error opening %s: %v", corpusFile, err)
+		}
+
+		var want interface{}
+		if err := d.Unmarshal(contents, &want); err != nil {
+			t.Errorf("unpacking %s generated an error: %v", corpusFile, err)
+			continue
+		}
+
+		b, err := e.Marshal(want)
+		if err != nil {
+			t.Errorf("packing %s generated an error: %v", corpusFile, err)
+			continue
+		}
+
+		var got interface{}
+		if err := d.Unmarshal(b, &got); err != nil {
+			t.Errorf("unpacking %s from Go generated an error: %v", corpusFile, err)
+			continue
+		}
+
+		// the same Perl value may decode into different Go types, such as
+		// *interface{} for a tracked reference, so compare what Perl would
+		// be sent
+		x, err := canonical.Marshal(want)
+		if err != nil {
+			t.Errorf("packing %s canonically generated an error: %v", corpusFile, err)
+			continue
+		}
+
+		y, err := canonical.Marshal(got)
+		if err != nil {
+			t.Errorf("packing %s from Go canonically generated an error: %v", corpusFile, err)
+			continue
+		}
+
+		if !bytes.Equal(x, y) {
+			t.Errorf("%s (%s) doesn't round trip:\ngot   : %#v\nwanted: %#v", corpusFile, bytes.TrimSpace(name), got, want)
+		}
 	}
 }
 
@@ -265,6 +363,126 @@ func TestSnappyArray(t *testing.T) {
 	}
 }
 
+func TestUnmarshalAt(t *testing.T) {
+
+	manydups := make([]interface{}, 2048)
+	for i := 0; i < len(manydups); i++ {
+		manydups[i] = "hello, world " + strconv.Itoa(i%10)
+	}
+
+	encoders := []*Encoder{
+		&Encoder{version: 1},
+		&Encoder{version: 1, Compression: SnappyCompressor{Incremental: false}},
+		&Encoder{version: 2, Compression: SnappyCompressor{Incremental: true}},
+		&Encoder{version: 3},
+		&Encoder{version: 3, Compression: ZlibCompressor{}},
+	}
+
+	// some garbage in front, to start at a non-zero offset
+	buf := []byte("garbage")
+
+	for i, e := range encoders {
+		e.CompressionThreshold = 0
+
+		b, err := e.Marshal(manydups)
+		if err != nil {
+			t.Fatalf("encoder #%d: marshalling generated an error: %v", i, err)
+		}
+
+		buf = append(buf, b...)
+	}
+
+	d := NewDecoder()
+	offset := len("garbage")
+
+	for i := range encoders {
+		var body interface{}
+		consumed, err := d.UnmarshalAt(buf, offset, nil, &body)
+		if err != nil {
+			t.Fatalf("document #%d at offset %d: unmarshalling generated an error: %v", i, offset, err)
+		}
+
+		if !reflect.DeepEqual(manydups, body) {
+			t.Errorf("document #%d at offset %d: bad body", i, offset)
+		}
+
+		offset += consumed
+	}
+
+	if offset != len(buf) {
+		t.Errorf("documents consumed %d bytes, expected %d", offset, len(buf))
+	}
+
+	var body interface{}
+	if _, err := d.UnmarshalAt(buf, offset, nil, &body); err != ErrTruncated {
+		t.Errorf("expected ErrTruncated at the end of the buffer, got %v", err)
+	}
+}
+
+func TestCanonical(t *testing.T) {
+
+	type A struct {
+		Name     string
+		Phone    string
+		Siblings int
+		Spouse   bool
+		Money    float64
+	}
+
+	body := map[string]interface{}{
+		"strmap": map[string]interface{}{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5, "f": 6},
+		"intmap": map[int]string{1: "a", 2: "b", 3: "c", 4: "d", 5: "e"},
+		"struct": A{"mr foo", "12345", 10, true, 123.45},
+		"mixed":  map[interface{}]int{"a": 1, 2: 2, "c": 3, 4: 4},
+	}
+
+	for _, perlCompat := range []bool{false, true} {
+		e := &Encoder{PerlCompat: perlCompat, Canonical: true}
+
+		expected, err := e.Marshal(body)
+		if err != nil {
+			t.Fatalf("perlCompat=%t: marshalling generated an error: %v", perlCompat, err)
+		}
+
+		for i := 0; i < 20; i++ {
+			b, err := e.Marshal(body)
+			if err != nil {
+				t.Fatalf("perlCompat=%t: marshalling generated an error: %v", perlCompat, err)
+			}
+
+			if !bytes.Equal(expected, b) {
+				t.Fatalf("perlCompat=%t: canonical encoding differs between runs:\n%s\n%s", perlCompat, hex.Dump(expected), hex.Dump(b))
+			}
+		}
+	}
+
+	// keys in byte-wise order, fields in declaration order
+	e := &Encoder{Canonical: true, version: 3}
+
+	b, err := e.Marshal(map[string]interface{}{"b": 1, "a": 2, "B": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, expected := hex.EncodeToString(b[6:]), "2a03270142032701610227016201"; got != expected {
+		t.Errorf("bad canonical hash:\ngot   : %s\nwanted: %s", got, expected)
+	}
+
+	b, err = e.Marshal(A{"x", "y", 1, false, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := -1
+	for _, f := range []string{"Name", "Phone", "Siblings", "Spouse", "Money"} {
+		offs := bytes.Index(b, []byte(f))
+		if offs <= last {
+			t.Errorf("struct field %s not in declaration order", f)
+		}
+		last = offs
+	}
+}
+
 func TestStructs(t *testing.T) {
 
 	type A struct {
@@ -305,7 +523,7 @@ func TestStructs(t *testing.T) {
 	type ATags struct {
 		Name     string `sereal:"Phone"`
 		Phone    string `sereal:"Name"`
-		Siblings int    // no tag, isn't unpacked
+		Siblings int    // no tag, still unpacked
 	}
 
 	type ALowerTags struct {
@@ -341,13 +559,13 @@ func TestStructs(t *testing.T) {
 			"decode struct with tags",
 			Afoo,
 			ATags{},
-			ATags{Name: "12345", Phone: "mr foo", Siblings: 0},
+			ATags{Name: "12345", Phone: "mr foo", Siblings: 10},
 		},
 		{
 			"encode struct with tags",
 			ATags{Name: "12345", Phone: "mr foo", Siblings: 10},
 			A{},
-			A{Name: "mr foo", Phone: "12345"},
+			A{Name: "mr foo", Phone: "12345", Siblings: 10},
 		},
 		{
 			"decode struct with lower-case field names",
@@ -421,6 +639,295 @@ func TestStructs(t *testing.T) {
 	}
 }
 
+func TestStructTagOptions(t *testing.T) {
+
+	type T struct {
+		Name    string  `sereal:"name"`
+		Skipped string  `sereal:"-"`
+		Nick    string  `sereal:",omitempty"`
+		Age     int     `sereal:"age,string"`
+		Ratio   float64 `sereal:",string"`
+		Admin   bool    `sereal:"admin,string,omitempty"`
+		Key     string  `sereal:"key,binary"`
+		Raw     []byte  `sereal:"raw,utf8"`
+		Plain   int
+	}
+
+	in := T{Name: "foo", Skipped: "bar", Age: 42, Ratio: 0.5, Key: "k", Raw: []byte("r"), Plain: 7}
+
+	e := &Encoder{}
+	d := &Decoder{}
+
+	x, err := e.Marshal(in)
+	if err != nil {
+		t.Fatalf("error marshalling: %s", err)
+	}
+
+	var m map[string]interface{}
+	if err := d.Unmarshal(x, &m); err != nil {
+		t.Fatalf("error unmarshalling into map: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"name":  "foo",
+		"age":   "42",
+		"Ratio": "0.5",
+		"key":   []byte("k"),
+		"raw":   "r",
+		"Plain": 7,
+	}
+
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("bad encoding: got %#v, expected %#v", m, expected)
+	}
+
+	var out T
+	if err := d.Unmarshal(x, &out); err != nil {
+		t.Fatalf("error unmarshalling into struct: %s", err)
+	}
+
+	in.Skipped = ""
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("roundtrip mismatch: got %#v, expected %#v", out, in)
+	}
+
+	// Perl may hand us numbers for string fields, and strings for the rest
+	x, err = e.Marshal(map[string]interface{}{"age": 3, "admin": "1", "Skipped": "x", "Nick": "n"})
+	if err != nil {
+		t.Fatalf("error marshalling map: %s", err)
+	}
+
+	out = T{}
+	if err := d.Unmarshal(x, &out); err != nil {
+		t.Fatalf("error unmarshalling map into struct: %s", err)
+	}
+
+	if want := (T{Age: 3, Admin: true, Nick: "n"}); !reflect.DeepEqual(out, want) {
+		t.Errorf("bad decoding: got %#v, expected %#v", out, want)
+	}
+}
+
+func TestEmbeddedStructs(t *testing.T) {
+
+	type Base struct {
+		ID     int
+		Name   string
+		Amb    string
+		Tagged string `sereal:"tag"`
+	}
+
+	type Extra struct {
+		Amb  string
+		Note string
+	}
+
+	type point struct {
+		X, Y int
+	}
+
+	type Opt struct {
+		Level int
+	}
+
+	type T struct {
+		Base
+		*Extra
+		point
+		Opt  `sereal:"opt"`
+		Name string
+	}
+
+	in := T{
+		Base:  Base{ID: 1, Name: "base", Amb: "a", Tagged: "t"},
+		Extra: &Extra{Amb: "b", Note: "n"},
+		point: point{1, 2},
+		Opt:   Opt{3},
+		Name:  "outer",
+	}
+
+	e := &Encoder{}
+	d := &Decoder{}
+
+	x, err := e.Marshal(in)
+	if err != nil {
+		t.Fatalf("error marshalling: %s", err)
+	}
+
+	var m map[string]interface{}
+	if err := d.Unmarshal(x, &m); err != nil {
+		t.Fatalf("error unmarshalling into map: %s", err)
+	}
+
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// the outer Name hides Base's, and the two Amb fields hide each other
+	if expected := []string{"ID", "Name", "Note", "X", "Y", "opt", "tag"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("bad encoding: got keys %v, expected %v", keys, expected)
+	}
+
+	if m["Name"] != "outer" {
+		t.Errorf("bad encoding: got Name %v, expected outer", m["Name"])
+	}
+
+	var out T
+	if err := d.Unmarshal(x, &out); err != nil {
+		t.Fatalf("error unmarshalling into struct: %s", err)
+	}
+
+	in.Base.Name, in.Base.Amb, in.Extra.Amb = "", "", ""
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("roundtrip mismatch: got %#v, expected %#v", out, in)
+	}
+
+	// the fields of a nil embedded pointer are left out, and allocated when decoding
+	in.Extra = nil
+	if x, err = e.Marshal(in); err != nil {
+		t.Fatalf("error marshalling: %s", err)
+	}
+
+	out = T{}
+	if err := d.Unmarshal(x, &out); err != nil {
+		t.Fatalf("error unmarshalling into struct: %s", err)
+	}
+
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("roundtrip mismatch: got %#v, expected %#v", out, in)
+	}
+
+	if x, err = e.Marshal(map[string]interface{}{"Note": "n", "X": 5}); err != nil {
+		t.Fatalf("error marshalling map: %s", err)
+	}
+
+	out = T{}
+	if err := d.Unmarshal(x, &out); err != nil {
+		t.Fatalf("error unmarshalling map into struct: %s", err)
+	}
+
+	if want := (T{Extra: &Extra{Note: "n"}, point: point{X: 5}}); !reflect.DeepEqual(out, want) {
+		t.Errorf("bad decoding: got %#v, expected %#v", out, want)
+	}
+}
+
+type testUUID [4]byte
+
+func (u testUUID) MarshalSereal() (interface{}, error) {
+	return hex.EncodeToString(u[:]), nil
+}
+
+func (u *testUUID) UnmarshalSereal(v Value) error {
+	var s string
+	if err := v.Decode(&s); err != nil {
+		return err
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	copy(u[:], b)
+	return nil
+}
+
+type testMoney struct {
+	cents    int64
+	currency string
+}
+
+func (m *testMoney) MarshalSereal() (interface{}, error) {
+	return map[string]interface{}{"amount": m.cents, "currency": m.currency}, nil
+}
+
+func (m *testMoney) UnmarshalSereal(v Value) error {
+	var h struct {
+		Amount   int64  `sereal:"amount"`
+		Currency string `sereal:"currency"`
+	}
+
+	if err := v.Decode(&h); err != nil {
+		return err
+	}
+
+	m.cents, m.currency = h.Amount, h.Currency
+	return nil
+}
+
+// testHash decodes itself entry by entry, as generated code does
+type testHash map[string]string
+
+func (h *testHash) UnmarshalSereal(v Value) error {
+	*h = testHash{}
+	return v.DecodeHash(func(key string, v Value) error {
+		var s string
+		if err := v.DecodeString(&s); err != nil {
+			return err
+		}
+		(*h)[key] = s
+		return nil
+	})
+}
+
+func TestMarshaler(t *testing.T) {
+
+	type account struct {
+		ID      testUUID
+		Balance *testMoney
+		Limit   *testMoney
+	}
+
+	in := account{
+		ID:      testUUID{0xde, 0xad, 0xbe, 0xef},
+		Balance: &testMoney{12345, "EUR"},
+	}
+
+	e := &Encoder{}
+	d := &Decoder{}
+
+	x, err := e.Marshal(in)
+	if err != nil {
+		t.Fatalf("error marshalling: %s", err)
+	}
+
+	// consumers which don't know about the Go types see plain values
+	var generic map[string]interface{}
+	if err := d.Unmarshal(x, &generic); err != nil {
+		t.Fatalf("error unmarshalling into map: %s", err)
+	}
+
+	expected := map[string]interface{}{
+		"ID":      "deadbeef",
+		"Balance": map[string]interface{}{"amount": 12345, "currency": "EUR"},
+		"Limit":   nil,
+	}
+
+	if !reflect.DeepEqual(generic, expected) {
+		t.Errorf("bad encoding: got %#v, expected %#v", generic, expected)
+	}
+
+	var out account
+	if err := d.Unmarshal(x, &out); err != nil {
+		t.Fatalf("error unmarshalling: %s", err)
+	}
+
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("roundtrip mismatch: got %#v, expected %#v", out, in)
+	}
+
+	// errors from UnmarshalSereal are returned to the caller
+	x, err = e.Marshal(map[string]interface{}{"ID": "not hex"})
+	if err != nil {
+		t.Fatalf("error marshalling: %s", err)
+	}
+
+	if err := d.Unmarshal(x, &out); err == nil {
+		t.Errorf("expected an error unmarshalling a bad UUID")
+	}
+}
+
 type ErrorBinaryUnmarshaler int
 
 var errUnmarshaler = errors.New("error binary unmarshaler")
@@ -524,23 +1031,519 @@ func TestBinaryMarshaller(t *testing.T) {
 	}
 }
 
-func TestUnmarshalHeaderError(t *testing.T) {
+func TestFreezeValues(t *testing.T) {
 
-	testcases := []struct {
-		docHex string
-		err    error
-	}{
-		// Garbage
-		{"badbadbadbad", ErrBadHeader},
-		// Version 1 and 2, "=srl"
-		{"3d73726c0100", nil},
-		{"3d73726c0200", nil},
-		// Version 3, "=srl" with a high-bit-set-on-the-"s"
-		{"3df3726c0300", nil},
-		// Version 3, "=srl" corrupted by accidental UTF8 encoding
-		{"3dc3b3726c0300", ErrBadHeaderUTF8},
-		// Forbidden version 2 and high-bit-set-on-the-"s" combination
-		{"3df3726c0200", ErrBadHeader},
+	type thawed struct {
+		name  string
+		count int
+	}
+
+	RegisterThaw("Test::Thawed", func(args []interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, errors.New("bad number of FREEZE values")
+		}
+		return &thawed{string(args[0].([]byte)), args[1].(int)}, nil
+	})
+
+	// [$obj, $obj] from Perl's encoder with freeze_callbacks enabled, where
+	// Test::Thawed::FREEZE returns ("a", 2)
+	perl, _ := hex.DecodeString("3df3726c030042326c546573743a3a54686177656428ab026161022911")
+
+	d := &Decoder{}
+
+	var body []interface{}
+	if err := d.Unmarshal(perl, &body); err != nil {
+		t.Fatalf("error unmarshalling Perl document: %s", err)
+	}
+
+	if len(body) != 2 {
+		t.Fatalf("bad body: %#v", body)
+	}
+
+	obj, ok := body[0].(*thawed)
+	if !ok || *obj != (thawed{"a", 2}) {
+		t.Errorf("bad thawed object: %#v", body[0])
+	}
+
+	// the second reference points at the thawed object too
+	if ref, ok := body[1].(**thawed); !ok || *ref != obj {
+		t.Errorf("bad reference to thawed object: %#v", body[1])
+	}
+
+	// unregistered classes decode to PerlFreeze, and encode back as they were
+	in := &PerlFreeze{Class: "Test::Frozen", Values: []interface{}{"x", 1, []interface{}{"y"}}}
+
+	e := &Encoder{PerlCompat: true}
+	d = &Decoder{PerlCompat: true}
+
+	x, err := e.Marshal(in)
+	if err != nil {
+		t.Fatalf("error marshalling PerlFreeze: %s", err)
+	}
+
+	var out interface{}
+	if err := d.Unmarshal(x, &out); err != nil {
+		t.Fatalf("error unmarshalling PerlFreeze: %s", err)
+	}
+
+	pfreeze, ok := out.(*PerlFreeze)
+	if !ok {
+		t.Fatalf("failed unpacking PerlFreeze: got %#v", out)
+	}
+
+	y, err := e.Marshal(pfreeze)
+	if err != nil {
+		t.Fatalf("error marshalling decoded PerlFreeze: %s", err)
+	}
+
+	if !bytes.Equal(x, y) {
+		t.Errorf("PerlFreeze roundtrip mismatch:\n%x\n%x", x, y)
+	}
+}
+
+func TestPerlRoundTrip(t *testing.T) {
+	elems := func(v interface{}) []interface{} {
+		return *v.(*[]interface{})
+	}
+
+	tests := []struct {
+		name  string
+		perl  string // document body from Perl's encoder
+		check func(v interface{}) bool
+	}{
+		{
+			"aliases",
+			"42a02a2e02", // [$x, $x] aliased
+			func(v interface{}) bool {
+				a, ok := elems(v)[0].(*PerlAlias)
+				return ok && a.Alias == 42 && elems(v)[1] == a
+			},
+		},
+		{
+			"scalar refs to same",
+			"4228a02a2903", // [\$x, \$x]
+			func(v interface{}) bool {
+				p, ok := elems(v)[0].(*int)
+				return ok && *p == 42 && elems(v)[1] == p
+			},
+		},
+		{
+			"undef aliases",
+			"42a52e02",
+			func(v interface{}) bool {
+				a, ok := elems(v)[0].(*PerlAlias)
+				return ok && elems(v)[1] == a
+			},
+		},
+		{
+			"weak thing ref",
+			"28a82b0230290201", // $x = \[weaken(\$x), 1]
+			func(v interface{}) bool {
+				w, ok := reflect.Indirect(reflect.ValueOf(v)).Elem().Elem().Interface().([]interface{})[0].(PerlWeakRef)
+				return ok && reflect.ValueOf(w.Reference).Elem().Pointer() == reflect.ValueOf(v).Elem().Pointer()
+			},
+		},
+		{
+			"frozen objects",
+			"42326c546573743a3a46726f7a656e28ab026161022911", // [$obj, $obj]
+			func(v interface{}) bool {
+				f, ok := elems(v)[0].(*PerlFreeze)
+				return ok && f.Class == "Test::Frozen" && len(f.Values) == 2 && elems(v)[1] == f
+			},
+		},
+	}
+
+	e := &Encoder{PerlCompat: true}
+	d := &Decoder{PerlCompat: true}
+
+	for _, tt := range tests {
+		perl, _ := hex.DecodeString("3df3726c0300" + tt.perl)
+
+		var v interface{}
+		if err := d.Unmarshal(perl, &v); err != nil {
+			t.Fatalf("%s: unmarshalling generated an error: %v", tt.name, err)
+		}
+
+		if !tt.check(v) {
+			t.Errorf("%s: bad value decoded from Perl: %s", tt.name, spew.Sdump(v))
+		}
+
+		b, err := e.Marshal(v)
+		if err != nil {
+			t.Fatalf("%s: marshalling generated an error: %v", tt.name, err)
+		}
+
+		var got interface{}
+		if err := d.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: unmarshalling %x generated an error: %v", tt.name, b, err)
+		}
+
+		if !tt.check(got) {
+			t.Errorf("%s: doesn't round trip: %x", tt.name, b)
+		}
+	}
+}
+
+func TestLongDouble(t *testing.T) {
+	third := func(prec uint) *big.Float {
+		return new(big.Float).SetPrec(prec).Quo(big.NewFloat(1), big.NewFloat(3))
+	}
+
+	huge := func(prec uint) *big.Float {
+		f, _, _ := new(big.Float).SetPrec(prec).Parse("1e4000", 10)
+		return f
+	}
+
+	// long doubles written by C on x86-64
+	tests := []struct {
+		format LongDoubleFormat
+		bytes  string
+		value  *big.Float
+	}{
+		{LongDoubleX87, "abaaaaaaaaaaaaaafd3f000000000000", third(64)},
+		{LongDoubleX87, "00000000000000c0ffbf000000000000", big.NewFloat(-1.5)},
+		{LongDoubleX87, "618c55fe2383bad1e673000000000000", huge(64)},
+		{LongDoubleX87, "01000000000000000000000000000000", new(big.Float).SetMantExp(big.NewFloat(1), -16445)},
+		{LongDoubleQuad, "5555555555555555555555555555fd3f", third(113)},
+		{LongDoubleQuad, "0000000000000000000000000080ffbf", big.NewFloat(-1.5)},
+		{LongDoubleQuad, "c30c4505b91ac218abfc470675a3e673", huge(113)},
+	}
+
+	for _, tt := range tests {
+		b, _ := hex.DecodeString("3df3726c030024" + tt.bytes)
+
+		var f *big.Float
+		if err := Unmarshal(b, &f); err != nil {
+			t.Fatalf("%s: unmarshalling generated an error: %v", tt.bytes, err)
+		}
+
+		if f.Cmp(tt.value) != 0 {
+			t.Errorf("%s: got %v, expected %v", tt.bytes, f, tt.value)
+		}
+
+		e := &Encoder{LongDouble: tt.format}
+		got, err := e.Marshal(tt.value)
+		if err != nil {
+			t.Fatalf("%s: marshalling generated an error: %v", tt.bytes, err)
+		}
+
+		if !bytes.Equal(got, b) {
+			t.Errorf("%v: got %x, expected %x", tt.value, got, b)
+		}
+
+		// into float64, unless it would be rounded
+		var x, exact float64
+		exact, acc := tt.value.Float64()
+
+		if err := Unmarshal(b, &x); err != nil || x != exact {
+			t.Errorf("%s: got %v (%v), expected %v", tt.bytes, x, err, exact)
+		}
+
+		var v interface{}
+		err = (&Decoder{StrictLongDouble: true}).Unmarshal(b, &v)
+		if acc == big.Exact && (err != nil || v != exact) {
+			t.Errorf("%s: got %v (%v), expected %v", tt.bytes, v, err, exact)
+		}
+		if acc != big.Exact && err != ErrLongDoublePrecision {
+			t.Errorf("%s: got %v, expected %v", tt.bytes, err, ErrLongDoublePrecision)
+		}
+	}
+
+	// infinities, and NaN which only fits a float64
+	for _, tt := range []string{"0000000000000080ff7f000000000000", "0000000000000000000000000000ffff"} {
+		b, _ := hex.DecodeString("3df3726c030024" + tt)
+
+		var f *big.Float
+		if err := Unmarshal(b, &f); err != nil || !f.IsInf() {
+			t.Errorf("%s: got %v (%v), expected an infinity", tt, f, err)
+		}
+	}
+
+	b, _ := hex.DecodeString("3df3726c030024" + "00000000000000c0ff7f000000000000")
+
+	var x float64
+	if err := Unmarshal(b, &x); err != nil || !math.IsNaN(x) {
+		t.Errorf("got %v (%v), expected NaN", x, err)
+	}
+
+	var f *big.Float
+	if err := Unmarshal(b, &f); err != ErrLongDoubleNaN {
+		t.Errorf("got %v, expected %v", err, ErrLongDoubleNaN)
+	}
+
+	// without a format, big.Floats are still strings
+	if got, _ := Marshal(big.NewFloat(1.5)); !bytes.Contains(got, []byte("1.5")) {
+		t.Errorf("got %x, expected a string", got)
+	}
+}
+
+func TestRegisterType(t *testing.T) {
+
+	type event struct {
+		Host net.IP
+		When time.Time
+	}
+
+	e := &Encoder{}
+	e.RegisterType(reflect.TypeOf(net.IP{}), func(v reflect.Value) (interface{}, error) {
+		return v.Interface().(net.IP).String(), nil
+	})
+	e.RegisterType(reflect.TypeOf(time.Time{}), func(v reflect.Value) (interface{}, error) {
+		return v.Interface().(time.Time).Format(time.RFC3339), nil
+	})
+
+	d := &Decoder{}
+	d.RegisterType(reflect.TypeOf(net.IP{}), func(v Value) (interface{}, error) {
+		var s string
+		if err := v.Decode(&s); err != nil {
+			return nil, err
+		}
+		return net.ParseIP(s), nil
+	})
+	d.RegisterType(reflect.TypeOf(time.Time{}), func(v Value) (interface{}, error) {
+		var s string
+		if err := v.Decode(&s); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339, s)
+	})
+
+	in := event{net.ParseIP("10.0.0.1"), time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)}
+
+	x, err := e.Marshal(in)
+	if err != nil {
+		t.Fatalf("error marshalling: %s", err)
+	}
+
+	var generic map[string]interface{}
+	if err := d.Unmarshal(x, &generic); err != nil {
+		t.Fatalf("error unmarshalling into map: %s", err)
+	}
+
+	expected := map[string]interface{}{"Host": "10.0.0.1", "When": "2015-03-01T12:00:00Z"}
+	if !reflect.DeepEqual(generic, expected) {
+		t.Errorf("bad encoding: got %#v, expected %#v", generic, expected)
+	}
+
+	var out event
+	if err := d.Unmarshal(x, &out); err != nil {
+		t.Fatalf("error unmarshalling: %s", err)
+	}
+
+	if !out.Host.Equal(in.Host) || !out.When.Equal(in.When) {
+		t.Errorf("roundtrip mismatch: got %#v, expected %#v", out, in)
+	}
+
+	// decoding Perl objects by class
+	type point struct{ X, Y int }
+
+	d.RegisterObjectFunc("Geo::Point", func(v Value) (interface{}, error) {
+		var p point
+		err := v.Decode(&p)
+		return &p, err
+	})
+
+	pe := &Encoder{PerlCompat: true}
+	x, err = pe.Marshal([]interface{}{&PerlObject{"Geo::Point", map[string]interface{}{"x": 1, "y": 2}}})
+	if err != nil {
+		t.Fatalf("error marshalling object: %s", err)
+	}
+
+	var objs []interface{}
+	if err := d.Unmarshal(x, &objs); err != nil {
+		t.Fatalf("error unmarshalling object: %s", err)
+	}
+
+	if len(objs) != 1 || !reflect.DeepEqual(objs[0], &point{1, 2}) {
+		t.Errorf("bad decoded object: %#v", objs)
+	}
+}
+
+type testUser struct {
+	_    struct{} `sereal:"MyApp::Model::User"`
+	Name string
+}
+
+type testGroup struct {
+	Name  string
+	Users []*testUser
+}
+
+func TestClasses(t *testing.T) {
+
+	RegisterClass(reflect.TypeOf(&testGroup{}), "MyApp::Model::Group")
+
+	in := &testGroup{"admins", []*testUser{{Name: "alice"}}}
+
+	e := &Encoder{PerlCompat: true}
+	pd := &Decoder{PerlCompat: true}
+
+	x, err := e.Marshal(*in)
+	if err != nil {
+		t.Fatalf("error marshalling: %s", err)
+	}
+
+	var perl interface{}
+	if err := pd.Unmarshal(x, &perl); err != nil {
+		t.Fatalf("error unmarshalling in PerlCompat mode: %s", err)
+	}
+
+	group, ok := perl.(*PerlObject)
+	if !ok || group.Class != "MyApp::Model::Group" {
+		t.Fatalf("bad group: %s", spew.Sdump(perl))
+	}
+
+	// a reference to the object, like the pointer
+	users := *(*group.Reference.(*map[string]interface{}))["Users"].(*[]interface{})
+	if user, ok := users[0].(**PerlObject); !ok || (*user).Class != "MyApp::Model::User" {
+		t.Errorf("bad user: %s", spew.Sdump(users[0]))
+	}
+
+	// registered classes decode back into their types
+	var out interface{}
+	if err := (&Decoder{}).Unmarshal(x, &out); err != nil {
+		t.Fatalf("error unmarshalling: %s", err)
+	}
+
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("roundtrip mismatch: got %s, expected %s", spew.Sdump(out), spew.Sdump(in))
+	}
+
+	// anonymous structs, and structs written by an UnblessedStructs encoder,
+	// are plain hashes
+	anon := struct{ Name string }{"bob"}
+	for _, e := range []*Encoder{{PerlCompat: true}, {PerlCompat: true, UnblessedStructs: true}} {
+		for _, v := range []interface{}{anon, testUser{Name: "bob"}} {
+			if v == anon || e.UnblessedStructs {
+				x, err := e.Marshal(v)
+				if err != nil {
+					t.Fatalf("error marshalling: %s", err)
+				}
+
+				var perl interface{}
+				if err := pd.Unmarshal(x, &perl); err != nil {
+					t.Fatalf("error unmarshalling in PerlCompat mode: %s", err)
+				}
+
+				if expected := (map[string]interface{}{"Name": "bob"}); !reflect.DeepEqual(perl, &expected) {
+					t.Errorf("%#v: got %s, expected a plain hash", v, spew.Sdump(perl))
+				}
+			}
+		}
+	}
+}
+
+type testColor struct{ r, g, b uint8 }
+
+func (c testColor) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("#%02x%02x%02x", c.r, c.g, c.b)), nil
+}
+
+func (c *testColor) UnmarshalText(text []byte) error {
+	_, err := fmt.Sscanf(string(text), "#%02x%02x%02x", &c.r, &c.g, &c.b)
+	return err
+}
+
+func TestMapKeys(t *testing.T) {
+
+	type palette struct {
+		Default testColor
+		Names   map[testColor]string
+	}
+
+	tests := []struct {
+		what     string
+		input    interface{}
+		expected map[string]interface{}
+	}{
+		{
+			"int keys",
+			map[int]string{-1: "a", 2: "b"},
+			map[string]interface{}{"-1": "a", "2": "b"},
+		},
+		{
+			"uint64 keys",
+			map[uint64]string{1 << 63: "a"},
+			map[string]interface{}{"9223372036854775808": "a"},
+		},
+		{
+			"bool keys",
+			map[bool]int{true: 1, false: 0},
+			map[string]interface{}{"1": 1, "": 0},
+		},
+		{
+			"TextMarshaler keys",
+			map[testColor]int{{255, 0, 0}: 1},
+			map[string]interface{}{"#ff0000": 1},
+		},
+		{
+			"TextMarshaler values",
+			palette{testColor{1, 2, 3}, map[testColor]string{{0, 0, 255}: "blue"}},
+			map[string]interface{}{"Default": "#010203", "Names": map[string]interface{}{"#0000ff": "blue"}},
+		},
+	}
+
+	d := &Decoder{}
+
+	for _, perlCompat := range []bool{false, true} {
+		e := &Encoder{PerlCompat: perlCompat}
+
+		for _, v := range tests {
+			x, err := e.Marshal(v.input)
+			if err != nil {
+				t.Errorf("perlCompat=%t: error marshalling %s: %s", perlCompat, v.what, err)
+				continue
+			}
+
+			if !perlCompat {
+				var generic map[string]interface{}
+				if err := d.Unmarshal(x, &generic); err != nil {
+					t.Errorf("error unmarshalling %s into map: %s", v.what, err)
+				} else if !reflect.DeepEqual(generic, v.expected) {
+					t.Errorf("bad encoding for %s: got %#v, expected %#v", v.what, generic, v.expected)
+				}
+			}
+
+			out := reflect.New(reflect.TypeOf(v.input))
+			if err := d.Unmarshal(x, out.Interface()); err != nil {
+				t.Errorf("perlCompat=%t: error unmarshalling %s: %s", perlCompat, v.what, err)
+				continue
+			}
+
+			if !reflect.DeepEqual(out.Elem().Interface(), v.input) {
+				t.Errorf("perlCompat=%t: roundtrip mismatch for %s: got %#v, expected %#v", perlCompat, v.what, out.Elem().Interface(), v.input)
+			}
+		}
+	}
+
+	if _, err := Marshal(map[[2]int]string{{1, 2}: "a"}); err == nil {
+		t.Errorf("expected an error marshalling unsupported map keys")
+	}
+
+	x, _ := Marshal(map[string]int{"x": 1})
+	var m map[int]int
+	if err := d.Unmarshal(x, &m); err == nil {
+		t.Errorf("expected an error unmarshalling a non-numeric key into map[int]int")
+	}
+}
+
+func TestUnmarshalHeaderError(t *testing.T) {
+
+	testcases := []struct {
+		docHex string
+		err    error
+	}{
+		// Garbage
+		{"badbadbadbad", ErrBadHeader},
+		// Version 1 and 2, "=srl"
+		{"3d73726c0100", nil},
+		{"3d73726c0200", nil},
+		// Version 3, "=srl" with a high-bit-set-on-the-"s"
+		{"3df3726c0300", nil},
+		// Version 3, "=srl" corrupted by accidental UTF8 encoding
+		{"3dc3b3726c0300", ErrBadHeaderUTF8},
+		// Forbidden version 2 and high-bit-set-on-the-"s" combination
+		{"3df3726c0200", ErrBadHeader},
 		// Forbidden version 3 and obsolete "=srl" magic string
 		{"3d73726c0300", ErrBadHeader},
 		// Non-existing (yet) version 4, "=srl" with a high-bit-set-on-the-"s"
@@ -568,3 +1571,789 @@ func TestUnmarshalHeaderError(t *testing.T) {
 		}
 	}
 }
+
+type compactFrozen string
+
+func (c compactFrozen) MarshalBinary() ([]byte, error) { return []byte(c), nil }
+
+func TestCompact(t *testing.T) {
+
+	type A struct {
+		Name  string
+		Phone string
+	}
+
+	body := []interface{}{
+		[]interface{}{1, 2, 3},
+		[]int{},
+		map[string]interface{}{"foo": "bar"},
+		map[string]int{"foo": 1, "bar": 2},
+		make([]interface{}, 20),
+		A{"mr foo", "12345"},
+		A{"mr bar", "54321"},
+		&PerlObject{"Foo::Bar", &map[string]interface{}{"foo": 1}},
+		&PerlObject{"Foo::Bar", &[]interface{}{1}},
+		compactFrozen("foo"),
+		compactFrozen("bar"),
+	}
+
+	for _, version := range []int{2, 3} {
+		e := &Encoder{PerlCompat: true, version: version}
+		full, err := e.Marshal(body)
+		if err != nil {
+			t.Fatalf("v%d: marshalling generated an error: %v", version, err)
+		}
+
+		e.Compact = true
+		compact, err := e.Marshal(body)
+		if err != nil {
+			t.Fatalf("v%d: compact marshalling generated an error: %v", version, err)
+		}
+
+		if len(compact) >= len(full) {
+			t.Errorf("v%d: compact encoding isn't smaller: compact=%d full=%d", version, len(compact), len(full))
+		}
+
+		for _, tag := range []byte{typeARRAYREF_0 + 3, typeHASHREF_0 + 1, typeOBJECTV, typeOBJECTV_FREEZE} {
+			if bytes.IndexByte(compact, tag) < 0 {
+				t.Errorf("v%d: compact encoding doesn't contain tag 0x%x", version, tag)
+			}
+		}
+
+		for _, perlCompat := range []bool{false, true} {
+			d := &Decoder{PerlCompat: perlCompat}
+
+			var expected, got interface{}
+			if err := d.Unmarshal(full, &expected); err != nil {
+				t.Fatalf("v%d, perlCompat=%t: unmarshalling generated an error: %v", version, perlCompat, err)
+			}
+
+			if err := d.Unmarshal(compact, &got); err != nil {
+				t.Fatalf("v%d, perlCompat=%t: compact unmarshalling generated an error: %v", version, perlCompat, err)
+			}
+
+			if !reflect.DeepEqual(expected, got) {
+				t.Errorf("v%d, perlCompat=%t: compact document decodes differently:\ngot   : %s\nwanted: %s", version, perlCompat, spew.Sdump(got), spew.Sdump(expected))
+			}
+		}
+	}
+}
+
+// sameContainer reports whether a and b, or what they point to, are the same
+// map or slice
+func sameContainer(a, b interface{}) bool {
+	va := reflect.Indirect(reflect.ValueOf(a))
+	vb := reflect.Indirect(reflect.ValueOf(b))
+	return va.Kind() == vb.Kind() && va.Pointer() == vb.Pointer()
+}
+
+type cycleNode struct {
+	Name string
+	Next *cycleNode
+}
+
+func TestCycles(t *testing.T) {
+	for _, perlCompat := range []bool{false, true} {
+		for _, compact := range []bool{false, true} {
+			e := &Encoder{PerlCompat: perlCompat, Compact: compact}
+			name := fmt.Sprintf("perlCompat=%t, compact=%t", perlCompat, compact)
+
+			m := map[string]interface{}{"name": "self"}
+			m["self"] = m
+
+			s := make([]interface{}, 2)
+			s[0] = "self"
+			s[1] = s
+
+			shared := map[string]interface{}{"x": 1}
+
+			b, err := e.Marshal([]interface{}{m, s, shared, shared})
+			if err != nil {
+				t.Fatalf("%s: marshalling generated an error: %v", name, err)
+			}
+
+			var got interface{}
+			if err := (&Decoder{PerlCompat: perlCompat}).Unmarshal(b, &got); err != nil {
+				t.Fatalf("%s: unmarshalling generated an error: %v", name, err)
+			}
+
+			// in PerlCompat mode everything is a reference to the container
+			arr := reflect.Indirect(reflect.ValueOf(got)).Interface().([]interface{})
+			gm := reflect.Indirect(reflect.ValueOf(arr[0])).Interface().(map[string]interface{})
+			if !sameContainer(gm["self"], gm) {
+				t.Errorf("%s: map isn't referencing itself: %s", name, spew.Sdump(gm))
+			}
+
+			gs := reflect.Indirect(reflect.ValueOf(arr[1])).Interface().([]interface{})
+			if !sameContainer(gs[1], gs) {
+				t.Errorf("%s: slice isn't referencing itself: %s", name, spew.Sdump(gs))
+			}
+
+			if !sameContainer(arr[2], arr[3]) {
+				t.Errorf("%s: shared map decoded as two maps", name)
+			}
+		}
+	}
+
+	a := &cycleNode{Name: "a"}
+	a.Next = &cycleNode{Name: "b", Next: a}
+
+	b, err := Marshal(a)
+	if err != nil {
+		t.Fatalf("marshalling a struct cycle generated an error: %v", err)
+	}
+
+	var got *cycleNode
+	if err := Unmarshal(b, &got); err != nil {
+		t.Fatalf("unmarshalling a struct cycle generated an error: %v", err)
+	}
+
+	if got.Name != "a" || got.Next.Name != "b" || got.Next.Next != got {
+		t.Errorf("struct cycle not preserved: %s", spew.Sdump(got))
+	}
+
+	// objects are tracked before their reference is decoded, which may
+	// refer back to them
+	header := []byte{0x3d, 0xf3, 0x72, 0x6c, 3, 0}
+	doc := append(header, typeOBJECT|trackFlag, typeSHORT_BINARY_0+3, 'F', 'o', 'o', typeREFN, typeARRAY, 1, typeALIAS, 1)
+
+	var obj interface{}
+	if err := (&Decoder{PerlCompat: true}).Unmarshal(doc, &obj); err != nil {
+		t.Fatalf("unmarshalling an object cycle generated an error: %v", err)
+	}
+
+	o, ok := obj.(*PerlObject)
+	if !ok {
+		t.Fatalf("object decoded as %T", obj)
+	}
+
+	if arr, ok := o.Reference.(*[]interface{}); !ok || len(*arr) != 1 || (*arr)[0] != obj {
+		t.Errorf("object cycle not preserved: %#v", o.Reference)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	var v interface{} = "leaf"
+	for i := 0; i < 10; i++ {
+		v = []interface{}{v}
+	}
+
+	e := &Encoder{MaxDepth: 10}
+	if _, err := e.Marshal(v); err != nil {
+		t.Errorf("marshalling at the maximum depth generated an error: %v", err)
+	}
+
+	e.MaxDepth = 9
+	if _, err := e.Marshal(v); err != ErrMaxDepth {
+		t.Errorf("expected ErrMaxDepth, got %v", err)
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	var nested interface{} = "leaf"
+	for i := 0; i < 10; i++ {
+		nested = []interface{}{nested}
+	}
+
+	hash := make(map[string]int)
+	array := make([]int, 20)
+	for i := range array {
+		hash[strconv.Itoa(i)] = i
+	}
+
+	long := strings.Repeat("long string ", 100)
+	raw, _ := Marshal(long)
+	bodySize := len(raw) - headerSize - 1 // without the header suffix
+
+	plain := NewEncoderV3()
+	zlib := &Encoder{version: 3, Compression: ZlibCompressor{}}
+	snappy := &Encoder{version: 3, Compression: SnappyCompressor{Incremental: true}}
+
+	tests := []struct {
+		e     *Encoder
+		v     interface{}
+		limit *LimitError
+		size  int
+		set   func(d *Decoder, max int)
+	}{
+		{plain, nested, ErrMaxRecursionDepth, 10, func(d *Decoder, max int) { d.MaxRecursionDepth = max }},
+		{plain, map[string]int{"a": 1, "b": 2}, ErrMaxNumHashEntries, 2, func(d *Decoder, max int) { d.MaxNumHashEntries = max }},
+		{plain, hash, ErrMaxNumHashEntries, 20, func(d *Decoder, max int) { d.MaxNumHashEntries = max }},
+		{plain, []int{1, 2}, ErrMaxNumArrayEntries, 2, func(d *Decoder, max int) { d.MaxNumArrayEntries = max }},
+		{plain, array, ErrMaxNumArrayEntries, 20, func(d *Decoder, max int) { d.MaxNumArrayEntries = max }},
+		{plain, "short", ErrMaxStringLength, 5, func(d *Decoder, max int) { d.MaxStringLength = max }},
+		{plain, []byte("short"), ErrMaxStringLength, 5, func(d *Decoder, max int) { d.MaxStringLength = max }},
+		{plain, []byte(long), ErrMaxStringLength, len(long), func(d *Decoder, max int) { d.MaxStringLength = max }},
+		{zlib, long, ErrMaxUncompressedSize, bodySize, func(d *Decoder, max int) { d.MaxUncompressedSize = max }},
+		{snappy, long, ErrMaxUncompressedSize, bodySize, func(d *Decoder, max int) { d.MaxUncompressedSize = max }},
+	}
+
+	for i, tt := range tests {
+		tt.e.CompressionThreshold = 0
+
+		b, err := tt.e.Marshal(tt.v)
+		if err != nil {
+			t.Fatalf("%d: marshalling generated an error: %v", i, err)
+		}
+
+		for _, max := range []int{0, tt.size} {
+			d := NewDecoder()
+			tt.set(d, max)
+
+			var v interface{}
+			if err := d.Unmarshal(append([]byte(nil), b...), &v); err != nil {
+				t.Errorf("%d: %s of %d: unmarshalling generated an error: %v", i, tt.limit.Limit, max, err)
+			}
+		}
+
+		d := NewDecoder()
+		tt.set(d, tt.size-1)
+
+		var v interface{}
+		err = d.Unmarshal(append([]byte(nil), b...), &v)
+		expected := &LimitError{Limit: tt.limit.Limit, Max: tt.size - 1, Size: tt.size}
+		if !reflect.DeepEqual(err, expected) {
+			t.Errorf("%d: expected %v, got %v", i, expected, err)
+		}
+
+		if !errors.Is(err, tt.limit) || errors.Is(err, ErrMaxRecursionDepth) != (tt.limit == ErrMaxRecursionDepth) {
+			t.Errorf("%d: %v doesn't match %v alone", i, err, tt.limit)
+		}
+	}
+
+	// zlib documents claiming more than deflate can reach, or less than
+	// they uncompress to
+	body, _ := ZlibCompressor{}.compress(make([]byte, 1<<20))
+	_, usz, _ := readVarint(body)
+
+	for _, uln := range []uint{1 << 40, 10} {
+		b := []byte{0x3d, 0xf3, 0x72, 0x6c, 3 | byte(serealZlib)<<4, 0}
+		b = varint(b, uln)
+		b = append(b, body[usz:]...)
+
+		var v interface{}
+		if err := Unmarshal(b, &v); err == nil {
+			t.Errorf("uncompressed size of %d: expected an error", uln)
+		}
+	}
+
+	// documents nesting deeper than the stack should go without a limit set
+	deep := []byte{0x3d, 0xf3, 0x72, 0x6c, 3, 0}
+	deep = append(deep, bytes.Repeat([]byte{typeREFN}, 1<<20)...)
+	deep = append(deep, typeUNDEF)
+
+	var v interface{}
+	err := Unmarshal(deep, &v)
+	expected := &LimitError{Limit: "MaxRecursionDepth", Max: DefaultMaxRecursionDepth, Size: DefaultMaxRecursionDepth + 1}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("deep nesting: expected %v, got %v", expected, err)
+	}
+
+	// arrays which each claim as many elements as there are bytes left
+	var arrays []byte
+	for i := 0; i < 1000; i++ {
+		arrays = append(varint([]byte{typeARRAY}, uint(len(arrays))), arrays...)
+	}
+
+	b := append([]byte{0x3d, 0xf3, 0x72, 0x6c, 3, 0}, arrays...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	err = Unmarshal(b, &v)
+	runtime.ReadMemStats(&after)
+
+	if err != ErrTruncated {
+		t.Errorf("nested arrays: expected ErrTruncated, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("nested arrays of %d bytes allocated %d bytes", len(b), allocated)
+	}
+}
+
+type policyObject struct {
+	Name string
+}
+
+func TestDecoderPolicies(t *testing.T) {
+	RegisterClass(reflect.TypeOf(policyObject{}), "Test::Policy")
+
+	objects := []interface{}{policyObject{"a"}, policyObject{"b"}}
+	b, err := Marshal(objects)
+	if err != nil {
+		t.Fatalf("marshalling objects generated an error: %v", err)
+	}
+
+	var body interface{}
+	if err := (&Decoder{RefuseObjects: true}).Unmarshal(b, &body); err != ErrRefusedObject {
+		t.Errorf("expected ErrRefusedObject, got %v", err)
+	}
+
+	body = nil
+	if err := (&Decoder{NoBlessObjects: true}).Unmarshal(b, &body); err != nil {
+		t.Errorf("unmarshalling objects without their class generated an error: %v", err)
+	}
+
+	expected := []interface{}{map[string]interface{}{"Name": "a"}, map[string]interface{}{"Name": "b"}}
+	if !reflect.DeepEqual(body, expected) {
+		t.Errorf("objects unmarshalled without their class:\ngot   : %s\nwanted: %s", spew.Sdump(body), spew.Sdump(expected))
+	}
+
+	thawed := false
+	RegisterThaw("Test::Refuse", func(args []interface{}) (interface{}, error) {
+		thawed = true
+		return nil, nil
+	})
+
+	// [$obj, $obj] from Perl's encoder with freeze_callbacks enabled, where
+	// Test::Refuse::FREEZE returns ("a", 2)
+	perl, _ := hex.DecodeString("3df3726c030042326c546573743a3a52656675736528ab026161022911")
+
+	frozen := map[*Decoder]error{
+		&Decoder{RefuseObjects: true}:  ErrRefusedObject,
+		&Decoder{RefuseFreeze: true}:   ErrRefusedFreeze,
+		&Decoder{NoBlessObjects: true}: nil,
+	}
+
+	for d, expected := range frozen {
+		var values []interface{}
+		if err := d.Unmarshal(perl, &values); err != expected {
+			t.Errorf("%+v: expected %v, got %v", *d, expected, err)
+		}
+
+		if d.NoBlessObjects && !reflect.DeepEqual(values[0], []interface{}{[]byte("a"), 2}) {
+			t.Errorf("frozen object unmarshalled without its class: %s", spew.Sdump(values))
+		}
+	}
+
+	if thawed {
+		t.Errorf("thaw function called by a decoder refusing it")
+	}
+
+	compressed := map[*Encoder]error{
+		&Encoder{version: 2, Compression: SnappyCompressor{Incremental: true}}: ErrRefusedSnappy,
+		&Encoder{version: 3, Compression: ZlibCompressor{}}:                    ErrRefusedZlib,
+	}
+
+	for e, expected := range compressed {
+		e.CompressionThreshold = 0
+		b, err := e.Marshal("compressed")
+		if err != nil {
+			t.Fatalf("marshalling generated an error: %v", err)
+		}
+
+		for _, d := range []*Decoder{{RefuseSnappy: true}, {RefuseZlib: true}} {
+			var s string
+			err := d.Unmarshal(append([]byte(nil), b...), &s)
+
+			refused := (d.RefuseSnappy && expected == ErrRefusedSnappy) || (d.RefuseZlib && expected == ErrRefusedZlib)
+			if refused && err != expected {
+				t.Errorf("%+v: expected %v, got %v", *d, expected, err)
+			} else if !refused && (err != nil || s != "compressed") {
+				t.Errorf("%+v: unmarshalling generated an error: %v", *d, err)
+			}
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	type planet struct {
+		MassEarths float64 `sereal:"mass_earths"`
+	}
+
+	var system struct {
+		Planets []planet `sereal:"planets"`
+	}
+
+	planets := []interface{}{}
+	for _, mass := range []interface{}{0.055, 0.815, 1.0, "0.107"} {
+		planets = append(planets, map[string]interface{}{"mass_earths": mass})
+	}
+
+	b, err := Marshal(map[string]interface{}{"planets": planets})
+	if err != nil {
+		t.Fatalf("marshalling generated an error: %v", err)
+	}
+
+	err = Unmarshal(b, &system)
+
+	de, ok := err.(*DecodeError)
+	if !ok {
+		t.Fatalf("expected a *DecodeError, got %v", err)
+	}
+
+	bodyStart := headerSize + 1
+	if de.Err != ErrTypeMismatch || de.Path != ".planets[3].mass_earths" || de.Type != reflect.TypeOf(0.0) || de.Tag != typeSTR_UTF8 || b[bodyStart+de.Offset] != de.Tag {
+		t.Errorf("bad error: %#v", de)
+	}
+
+	expected := "sereal: value doesn't fit the type decoded into at .planets[3].mass_earths (offset " + strconv.Itoa(de.Offset) + ", tag 0x27, decoding into float64)"
+	if de.Error() != expected {
+		t.Errorf("bad message:\ngot   : %s\nwanted: %s", de.Error(), expected)
+	}
+
+	// v3 bodies
+	tests := []struct {
+		body   string
+		v      interface{}
+		err    error
+		path   string
+		offset int
+	}{
+		{"42" + "01" + "2905", new(interface{}), ErrCorrupt{errUntrackedOffsetREFP}, "[1]", 2},
+		{"42" + "34" + "01", new(interface{}), ErrUnknownTag, "[0]", 1},
+		{"20" + "ffffffffffffffffffffff01", new(interface{}), ErrCorrupt{errBadVarint}, "", 0},
+		{"51" + "63616263" + "01", new(map[int]int), ErrTypeMismatch, "", 0},
+		{"51" + "6161" + "01", new(map[string]string), ErrTypeMismatch, ".a", 3},
+		{"3b", new(int), ErrTypeMismatch, "", 0},
+		{"01", new([]int), ErrTypeMismatch, "", 0},
+		{"41" + "01", new([]testHash), ErrTypeMismatch, "[0]", 1},
+	}
+
+	for i, tt := range tests {
+		body, _ := hex.DecodeString(tt.body)
+		doc := append([]byte{0x3d, 0xf3, 0x72, 0x6c, 3, 0}, body...)
+
+		err := Unmarshal(doc, tt.v)
+
+		de, ok := err.(*DecodeError)
+		if !ok || de.Err != tt.err || de.Path != tt.path || de.Offset != tt.offset || de.Tag != body[tt.offset]&^trackFlag {
+			t.Errorf("%d: bad error: %#v", i, err)
+		}
+	}
+
+	if err := (ErrCorrupt{errBadOffset}); err.Error() != "sereal: corrupt document: bad offset" {
+		t.Errorf("detail missing from ErrCorrupt: %s", err)
+	}
+}
+
+func TestDecoderConcurrent(t *testing.T) {
+	type planet struct {
+		Name   string
+		Moons  []string
+		Mass   float64 `sereal:"mass,string"`
+		Ringed bool
+	}
+
+	type system struct {
+		ID      testUUID
+		Star    *testMoney
+		Planets []planet
+		ByName  map[string]*planet
+	}
+
+	in := system{
+		ID:      testUUID{1, 2, 3, 4},
+		Star:    &testMoney{100, "EUR"},
+		Planets: []planet{{"Earth", []string{"Moon"}, 1, false}, {"Saturn", []string{"Titan"}, 95.16, true}},
+	}
+	in.ByName = map[string]*planet{"Earth": &in.Planets[0]}
+
+	docs := make([][]byte, 3)
+	for i, e := range []*Encoder{NewEncoderV3(), NewEncoderV2(), {version: 3, DedupeStrings: true}} {
+		b, err := e.Marshal(in)
+		if err != nil {
+			t.Fatalf("marshalling generated an error: %v", err)
+		}
+		docs[i] = b
+	}
+
+	// one decoder for all, compiling the plans of the types at the same time
+	d := NewDecoder()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				var out system
+				if err := d.Unmarshal(docs[(g+i)%len(docs)], &out); err != nil {
+					t.Errorf("unmarshalling generated an error: %v", err)
+					return
+				}
+
+				if !reflect.DeepEqual(out, in) {
+					t.Errorf("concurrent decoding mismatch:\ngot   : %s\nwanted: %s", spew.Sdump(out), spew.Sdump(in))
+					return
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+}
+
+func TestEncoderConcurrent(t *testing.T) {
+	type tree struct {
+		Kids  []tree
+		Name  string
+		Rings map[string]float64
+	}
+
+	in := []tree{
+		{Name: "Sun", Kids: []tree{{Name: "Earth", Kids: []tree{{Name: "Moon"}}}, {Name: "Saturn", Rings: map[string]float64{"A": 1.5, "B": 2}}}},
+	}
+
+	// the same tree made of the generic maps and slices encode switches on
+	generic := []interface{}{
+		map[string]interface{}{"Name": "Sun", "Rings": map[string]interface{}{}, "Kids": []interface{}{
+			map[string]interface{}{"Name": "Earth", "Rings": map[string]interface{}{}, "Kids": []interface{}{
+				map[string]interface{}{"Name": "Moon", "Rings": map[string]interface{}{}, "Kids": []interface{}{}},
+			}},
+			map[string]interface{}{"Name": "Saturn", "Kids": []interface{}{}, "Rings": map[string]interface{}{"A": 1.5, "B": 2.0}},
+		}},
+	}
+
+	e := &Encoder{UnblessedStructs: true, Canonical: true}
+
+	expected, err := e.Marshal(generic)
+	if err != nil {
+		t.Fatalf("marshalling generated an error: %v", err)
+	}
+
+	// the encoders of the types are compiled at the same time
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				b, err := e.Marshal(in)
+				if err != nil {
+					t.Errorf("marshalling generated an error: %v", err)
+					return
+				}
+
+				if !bytes.Equal(b, expected) {
+					t.Errorf("concurrent encoding mismatch:\ngot   : %s\nwanted: %s", hex.Dump(b), hex.Dump(expected))
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+type testHook func()
+
+func (testHook) String() string { return "hook" }
+
+func TestUnknownTypes(t *testing.T) {
+	type T struct {
+		Name   string
+		Params map[string]interface{}
+		Hooks  []testHook
+		Roots  map[complex128]int
+		Scale  complex128
+	}
+
+	tests := []struct {
+		in   T
+		typ  reflect.Type
+		path string
+	}{
+		{T{Params: map[string]interface{}{"done": make(chan int)}}, reflect.TypeOf(make(chan int)), `.Params["done"]`},
+		{T{Hooks: []testHook{nil}}, reflect.TypeOf(testHook(nil)), ".Hooks[0]"},
+		{T{}, reflect.TypeOf(complex128(0)), ".Scale"},
+		{T{Roots: map[complex128]int{1i: 1}}, reflect.TypeOf(complex128(0)), ".Roots"},
+	}
+
+	for _, tt := range tests {
+		_, err := Marshal(tt.in)
+		if ute, ok := err.(*UnsupportedTypeError); !ok || ute.Type != tt.typ || ute.Path != tt.path {
+			t.Errorf("expected an unsupported %v at %s, got %v", tt.typ, tt.path, err)
+		}
+	}
+
+	in := T{"x", map[string]interface{}{"done": make(chan int)}, []testHook{nil}, map[complex128]int{1i: 1}, complex(1, 2)}
+
+	expected := map[UnknownPolicy]map[string]interface{}{
+		UndefUnknown: {
+			"Name":   "x",
+			"Params": map[string]interface{}{"done": nil},
+			"Hooks":  []interface{}{nil},
+			"Scale":  nil,
+			"Roots":  map[string]interface{}{},
+		},
+		StringifyUnknown: {
+			"Name":   "x",
+			"Params": map[string]interface{}{"done": fmt.Sprint(in.Params["done"])},
+			"Hooks":  []interface{}{"hook"},
+			"Scale":  "(1+2i)",
+			"Roots":  map[string]interface{}{"(0+1i)": 1},
+		},
+	}
+
+	for policy, want := range expected {
+		b, err := (&Encoder{Unknown: policy}).Marshal(in)
+		if err != nil {
+			t.Fatalf("policy %d: marshalling generated an error: %v", policy, err)
+		}
+
+		var got map[string]interface{}
+		if err := Unmarshal(b, &got); err != nil {
+			t.Fatalf("policy %d: unmarshalling generated an error: %v", policy, err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("policy %d: got %s, expected %s", policy, spew.Sdump(got), spew.Sdump(want))
+		}
+	}
+}
+
+func TestDedupeStrings(t *testing.T) {
+	type Country struct {
+		Name string
+		Code string `sereal:",binary"`
+	}
+
+	body := []interface{}{
+		"Netherlands", "Netherlands", "NL", "NL",
+		[]byte("Netherlands"), []byte("Netherlands"),
+		Country{"Netherlands", "NLD"},
+		Country{"Netherlands", "NLD"},
+	}
+
+	plain, err := Marshal(body)
+	if err != nil {
+		t.Fatalf("marshalling generated an error: %v", err)
+	}
+
+	for _, aliased := range []bool{false, true} {
+		for _, perlCompat := range []bool{false, true} {
+			name := fmt.Sprintf("aliased=%t, perlCompat=%t", aliased, perlCompat)
+			e := &Encoder{PerlCompat: perlCompat, DedupeStrings: !aliased, AliasedDedupeStrings: aliased}
+
+			b, err := e.Marshal(body)
+			if err != nil {
+				t.Fatalf("%s: marshalling generated an error: %v", name, err)
+			}
+
+			if len(b) >= len(plain) {
+				t.Errorf("%s: deduplicated document isn't smaller: %d >= %d", name, len(b), len(plain))
+			}
+
+			if bytes.Count(b, []byte("Netherlands")) != 2 {
+				t.Errorf("%s: expected one string and one binary copy of the value: %x", name, b)
+			}
+
+			if bytes.Count(b, []byte{typeSTR_UTF8, 2, 'N', 'L'}) != 2 || bytes.Count(b, []byte("NLD")) != 2 {
+				t.Errorf("%s: short strings shouldn't be deduplicated: %x", name, b)
+			}
+
+			tag := byte(typeCOPY)
+			if aliased {
+				tag = typeALIAS
+			}
+
+			if bytes.IndexByte(b, tag) < 0 {
+				t.Errorf("%s: document doesn't contain tag 0x%x: %x", name, tag, b)
+			}
+
+			var got []interface{}
+			if err := Unmarshal(b, &got); err != nil {
+				t.Fatalf("%s: unmarshalling generated an error: %v", name, err)
+			}
+
+			var expected []interface{}
+			if err := Unmarshal(plain, &expected); err != nil {
+				t.Fatalf("%s: unmarshalling generated an error: %v", name, err)
+			}
+
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: deduplicated document decodes differently:\ngot   : %s\nwanted: %s", name, spew.Sdump(got), spew.Sdump(expected))
+			}
+		}
+	}
+}
+
+func TestMarshalAppend(t *testing.T) {
+	body := map[string]interface{}{"foo": []interface{}{"bar", 1, 2.5}, "baz": "quux"}
+
+	encoders := []*Encoder{NewEncoder(), NewEncoderV2(), NewEncoderV3()}
+
+	snappy := NewEncoderV3()
+	snappy.Compression = SnappyCompressor{Incremental: true}
+	snappy.CompressionThreshold = 0
+	encoders = append(encoders, snappy)
+
+	for _, e := range encoders {
+		expected, err := e.MarshalWithHeader("header", body)
+		if err != nil {
+			t.Fatalf("v%d: marshalling generated an error: %v", e.version, err)
+		}
+
+		prefix := []byte("prefix")
+		buf := append([]byte(nil), prefix...)
+
+		for i := 0; i < 3; i++ {
+			if buf, err = e.MarshalAppend(buf[:len(prefix)], "header", body); err != nil {
+				t.Fatalf("v%d: appending generated an error: %v", e.version, err)
+			}
+
+			if !bytes.Equal(buf[:len(prefix)], prefix) {
+				t.Errorf("v%d: prefix overwritten: %q", e.version, buf[:len(prefix)])
+			}
+
+			// decoding reuses the buffer of compressed documents
+			doc := func() []byte { return append([]byte(nil), buf[len(prefix):]...) }
+
+			// hash order is random, compare the decoded documents
+			var header string
+			var got, wanted interface{}
+			if err := Unmarshal(doc(), &got); err != nil {
+				t.Fatalf("v%d: unmarshalling generated an error: %v", e.version, err)
+			}
+
+			if err := Unmarshal(append([]byte(nil), expected...), &wanted); err != nil {
+				t.Fatalf("v%d: unmarshalling generated an error: %v", e.version, err)
+			}
+
+			if !reflect.DeepEqual(got, wanted) {
+				t.Errorf("v%d: appended document decodes differently:\ngot   : %s\nwanted: %s", e.version, spew.Sdump(got), spew.Sdump(wanted))
+			}
+
+			if e.version >= 2 {
+				if err := NewDecoder().UnmarshalHeaderBody(doc(), &header, nil); err != nil || header != "header" {
+					t.Errorf("v%d: bad header %q: %v", e.version, header, err)
+				}
+			}
+		}
+	}
+}
+
+func TestMarshalAppendAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("pooled encoder state isn't reused reliably under the race detector")
+	}
+
+	body := map[string]interface{}{
+		"id":     123456789,
+		"method": "users.search",
+		"params": map[string]interface{}{"fields": []interface{}{"id", "name"}, "limit": 100, "timeout": 1.5},
+		"flags":  []string{"a", "b"},
+	}
+
+	e := NewEncoderV3()
+
+	// warm up the pooled tables and buffer
+	buf, err := e.MarshalAppend(nil, nil, body)
+	if err != nil {
+		t.Fatalf("marshalling generated an error: %v", err)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, err = e.MarshalAppend(buf[:0], nil, body)
+	})
+
+	if err != nil {
+		t.Fatalf("marshalling generated an error: %v", err)
+	}
+
+	if allocs > 0 {
+		t.Errorf("MarshalAppend allocates %v times per document in steady state", allocs)
+	}
+}
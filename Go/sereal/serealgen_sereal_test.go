@@ -0,0 +1,477 @@
+// Code generated by serealgen. DO NOT EDIT.
+
+package sereal_test
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sereal/Sereal/Go/sereal"
+)
+
+// MarshalSereal implements sereal.StructMarshaler
+func (v *GenRequest) MarshalSereal(w *sereal.Writer) error {
+	n := 15
+	if len(v.GenBase.Trace) == 0 {
+		n--
+	}
+	if v.Limit == 0 {
+		n--
+	}
+	if v.Score == 0 {
+		n--
+	}
+
+	w.BeginObject("GenRequest", n)
+
+	if len(v.GenBase.Trace) != 0 {
+		w.Key("trace")
+		w.String(v.GenBase.Trace)
+	}
+
+	w.Key("ID")
+	w.Int(v.ID)
+
+	w.Key("Method")
+	w.String(v.Method)
+
+	w.Key("Params")
+	if err := w.Value(v.Params); err != nil {
+		return err
+	}
+
+	w.Key("Tags")
+	if w.BeginArray(&v.Tags) {
+		for _, e := range v.Tags {
+			w.String(e)
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		if err := w.End(); err != nil {
+			return err
+		}
+	}
+
+	if v.Limit != 0 {
+		w.Key("limit")
+		w.Int(int64(v.Limit))
+	}
+
+	w.Key("ratio")
+	w.Float32(v.Ratio)
+
+	if v.Score != 0 {
+		w.Key("Score")
+		w.Float64(v.Score)
+	}
+
+	w.Key("Active")
+	w.Bool(v.Active)
+
+	w.Key("Count")
+	w.String(strconv.FormatUint(uint64(v.Count), 10))
+
+	w.Key("Body")
+	w.Binary(v.Body)
+
+	w.Key("Note")
+	w.BinaryString(v.Note)
+
+	w.Key("Raw")
+	w.String(string(v.Raw))
+
+	w.Key("Client")
+	if err := w.Struct(&v.Client); err != nil {
+		return err
+	}
+
+	w.Key("Next")
+	if err := w.Value(v.Next); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UnmarshalSereal implements sereal.Unmarshaler
+func (v *GenRequest) UnmarshalSereal(val sereal.Value) error {
+	return val.DecodeHash(v.unmarshalSerealField)
+}
+
+func (v *GenRequest) unmarshalSerealField(key string, f sereal.Value) error {
+	switch key {
+	case "trace":
+		return f.DecodeString(&v.GenBase.Trace)
+	case "ID":
+		return f.DecodeInt(&v.ID)
+	case "Method":
+		return f.DecodeString(&v.Method)
+	case "Params":
+		return f.Decode(&v.Params)
+	case "Tags":
+		return f.Decode(&v.Tags)
+	case "limit":
+		n := int64(v.Limit)
+		if err := f.DecodeInt(&n); err != nil {
+			return err
+		}
+		v.Limit = int32(n)
+		return nil
+	case "ratio":
+		n := float64(v.Ratio)
+		if err := f.DecodeFloat(&n); err != nil {
+			return err
+		}
+		v.Ratio = float32(n)
+		return nil
+	case "Score":
+		return f.DecodeFloat(&v.Score)
+	case "Active":
+		return f.DecodeBool(&v.Active)
+	case "Count":
+		return f.DecodeStringOption(&v.Count)
+	case "Body":
+		return f.DecodeBytes(&v.Body)
+	case "Note":
+		return f.DecodeString(&v.Note)
+	case "Raw":
+		return f.DecodeBytes(&v.Raw)
+	case "Client":
+		return f.Decode(&v.Client)
+	case "Next":
+		return f.Decode(&v.Next)
+	default:
+		// like the decoder, fall back to the title-cased key
+		if t := strings.Title(key); t != key {
+			return v.unmarshalSerealField(t, f)
+		}
+	}
+
+	return nil
+}
+
+// MarshalSereal implements sereal.StructMarshaler
+func (v *GenClient) MarshalSereal(w *sereal.Writer) error {
+	n := 2
+
+	w.BeginObject("GenClient", n)
+
+	w.Key("Name")
+	w.String(v.Name)
+
+	w.Key("Version")
+	w.Uint(uint64(v.Version))
+
+	return nil
+}
+
+// UnmarshalSereal implements sereal.Unmarshaler
+func (v *GenClient) UnmarshalSereal(val sereal.Value) error {
+	return val.DecodeHash(v.unmarshalSerealField)
+}
+
+func (v *GenClient) unmarshalSerealField(key string, f sereal.Value) error {
+	switch key {
+	case "Name":
+		return f.DecodeString(&v.Name)
+	case "Version":
+		n := uint64(v.Version)
+		if err := f.DecodeUint(&n); err != nil {
+			return err
+		}
+		v.Version = uint8(n)
+		return nil
+	default:
+		// like the decoder, fall back to the title-cased key
+		if t := strings.Title(key); t != key {
+			return v.unmarshalSerealField(t, f)
+		}
+	}
+
+	return nil
+}
+
+// MarshalSereal implements sereal.StructMarshaler
+func (v *GenEvent) MarshalSereal(w *sereal.Writer) error {
+	n := 1
+
+	w.BeginObject("MyApp::Event", n)
+
+	w.Key("Name")
+	w.String(v.Name)
+
+	return nil
+}
+
+// UnmarshalSereal implements sereal.Unmarshaler
+func (v *GenEvent) UnmarshalSereal(val sereal.Value) error {
+	return val.DecodeHash(v.unmarshalSerealField)
+}
+
+func (v *GenEvent) unmarshalSerealField(key string, f sereal.Value) error {
+	switch key {
+	case "Name":
+		return f.DecodeString(&v.Name)
+	default:
+		// like the decoder, fall back to the title-cased key
+		if t := strings.Title(key); t != key {
+			return v.unmarshalSerealField(t, f)
+		}
+	}
+
+	return nil
+}
+
+// MarshalSereal implements sereal.StructMarshaler
+func (v *GenSolarSystem) MarshalSereal(w *sereal.Writer) error {
+	n := 8
+	if len(v.ByName) == 0 {
+		n--
+	}
+	if len(v.Masses) == 0 {
+		n--
+	}
+	if len(v.Rings) == 0 {
+		n--
+	}
+	if len(v.Photos) == 0 {
+		n--
+	}
+
+	w.BeginObject("GenSolarSystem", n)
+
+	w.Key("galaxy")
+	w.String(v.Galaxy)
+
+	w.Key("age")
+	w.Int(int64(v.Age))
+
+	w.Key("stars")
+	if w.BeginArray(&v.Stars) {
+		for _, e := range v.Stars {
+			w.String(e)
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		if err := w.End(); err != nil {
+			return err
+		}
+	}
+
+	w.Key("planets")
+	if w.BeginArray(&v.Planets) {
+		for i := range v.Planets {
+			if err := w.StructElem(i, &v.Planets[i]); err != nil {
+				return err
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		if err := w.End(); err != nil {
+			return err
+		}
+	}
+
+	if len(v.ByName) != 0 {
+		w.Key("by_name")
+		if w.BeginHash(&v.ByName) {
+			if w.Canonical() {
+				keys := make([]string, 0, len(v.ByName))
+				for k := range v.ByName {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					e := v.ByName[k]
+					w.MapKey(k)
+					if err := w.StructEntry(k, &e); err != nil {
+						return err
+					}
+					if err := w.Flush(); err != nil {
+						return err
+					}
+				}
+			} else {
+				for k, e := range v.ByName {
+					w.MapKey(k)
+					if err := w.StructEntry(k, &e); err != nil {
+						return err
+					}
+					if err := w.Flush(); err != nil {
+						return err
+					}
+				}
+			}
+			if err := w.End(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(v.Masses) != 0 {
+		w.Key("masses")
+		if w.BeginHash(&v.Masses) {
+			if w.Canonical() {
+				keys := make([]string, 0, len(v.Masses))
+				for k := range v.Masses {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				for _, k := range keys {
+					e := v.Masses[k]
+					w.MapKey(k)
+					w.Float64(e)
+					if err := w.Flush(); err != nil {
+						return err
+					}
+				}
+			} else {
+				for k, e := range v.Masses {
+					w.MapKey(k)
+					w.Float64(e)
+					if err := w.Flush(); err != nil {
+						return err
+					}
+				}
+			}
+			if err := w.End(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(v.Rings) != 0 {
+		w.Key("rings")
+		if w.BeginArray(&v.Rings) {
+			for _, e := range v.Rings {
+				w.Bool(e)
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+			if err := w.End(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(v.Photos) != 0 {
+		w.Key("photos")
+		if w.BeginArray(&v.Photos) {
+			for _, e := range v.Photos {
+				w.Binary(e)
+				if err := w.Flush(); err != nil {
+					return err
+				}
+			}
+			if err := w.End(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalSereal implements sereal.Unmarshaler
+func (v *GenSolarSystem) UnmarshalSereal(val sereal.Value) error {
+	return val.DecodeHash(v.unmarshalSerealField)
+}
+
+func (v *GenSolarSystem) unmarshalSerealField(key string, f sereal.Value) error {
+	switch key {
+	case "galaxy":
+		return f.DecodeString(&v.Galaxy)
+	case "age":
+		n := int64(v.Age)
+		if err := f.DecodeInt(&n); err != nil {
+			return err
+		}
+		v.Age = int(n)
+		return nil
+	case "stars":
+		return f.Decode(&v.Stars)
+	case "planets":
+		return f.Decode(&v.Planets)
+	case "by_name":
+		return f.Decode(&v.ByName)
+	case "masses":
+		return f.Decode(&v.Masses)
+	case "rings":
+		return f.Decode(&v.Rings)
+	case "photos":
+		return f.Decode(&v.Photos)
+	default:
+		// like the decoder, fall back to the title-cased key
+		if t := strings.Title(key); t != key {
+			return v.unmarshalSerealField(t, f)
+		}
+	}
+
+	return nil
+}
+
+// MarshalSereal implements sereal.StructMarshaler
+func (v *GenPlanet) MarshalSereal(w *sereal.Writer) error {
+	n := 4
+
+	w.BeginObject("GenPlanet", n)
+
+	w.Key("pos")
+	w.Int(int64(v.Pos))
+
+	w.Key("name")
+	w.String(v.Name)
+
+	w.Key("mass_earths")
+	w.Float64(v.MassEarths)
+
+	w.Key("notable_satellites")
+	if w.BeginArray(&v.NotableSatellites) {
+		for _, e := range v.NotableSatellites {
+			w.String(e)
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		if err := w.End(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UnmarshalSereal implements sereal.Unmarshaler
+func (v *GenPlanet) UnmarshalSereal(val sereal.Value) error {
+	return val.DecodeHash(v.unmarshalSerealField)
+}
+
+func (v *GenPlanet) unmarshalSerealField(key string, f sereal.Value) error {
+	switch key {
+	case "pos":
+		n := int64(v.Pos)
+		if err := f.DecodeInt(&n); err != nil {
+			return err
+		}
+		v.Pos = int(n)
+		return nil
+	case "name":
+		return f.DecodeString(&v.Name)
+	case "mass_earths":
+		return f.DecodeFloat(&v.MassEarths)
+	case "notable_satellites":
+		return f.Decode(&v.NotableSatellites)
+	default:
+		// like the decoder, fall back to the title-cased key
+		if t := strings.Title(key); t != key {
+			return v.unmarshalSerealField(t, f)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,402 @@
+package sereal_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/Sereal/Sereal/Go/sereal"
+	"github.com/davecgh/go-spew/spew"
+)
+
+//go:generate go run ./cmd/serealgen -type GenRequest,GenClient,GenEvent,GenPlanet,GenSolarSystem -output serealgen_sereal_test.go serealgen_test.go
+
+type GenRequest struct {
+	GenBase
+	ID      int64
+	Method  string
+	Params  map[string]interface{}
+	Tags    []string
+	Limit   int32   `sereal:"limit,omitempty"`
+	Ratio   float32 `sereal:"ratio"`
+	Score   float64 `sereal:",omitempty"`
+	Active  bool
+	Count   uint16 `sereal:",string"`
+	Body    []byte
+	Note    string `sereal:",binary"`
+	Raw     []byte `sereal:",utf8"`
+	Client  GenClient
+	Next    *GenRequest
+	Skipped string `sereal:"-"`
+	private int
+}
+
+// GenBase is promoted into GenRequest, its Method hidden by GenRequest's
+type GenBase struct {
+	Trace  string `sereal:"trace,omitempty"`
+	Method string
+}
+
+type GenClient struct {
+	Name    string
+	Version uint8
+}
+
+type GenEvent struct {
+	_    struct{} `sereal:"MyApp::Event"`
+	Name string
+}
+
+// GenSolarSystem is the solarSystem of the benchmarks as typed structs, with
+// maps of them
+type GenSolarSystem struct {
+	Galaxy  string               `sereal:"galaxy"`
+	Age     int                  `sereal:"age"`
+	Stars   []string             `sereal:"stars"`
+	Planets []GenPlanet          `sereal:"planets"`
+	ByName  map[string]GenPlanet `sereal:"by_name,omitempty"`
+	Masses  map[string]float64   `sereal:"masses,omitempty"`
+	Rings   []bool               `sereal:"rings,omitempty"`
+	Photos  [][]byte             `sereal:"photos,omitempty"`
+}
+
+type GenPlanet struct {
+	Pos               int      `sereal:"pos"`
+	Name              string   `sereal:"name"`
+	MassEarths        float64  `sereal:"mass_earths"`
+	NotableSatellites []string `sereal:"notable_satellites"`
+}
+
+// The reflection based twins of the generated types.  Their names have the
+// same length, so the documents only differ in the class names.
+type (
+	RefRequest GenRequest
+	RefClient  GenClient
+	RefEvent   GenEvent
+	RefPlanet  GenPlanet
+)
+
+type RefSolarSystem struct {
+	Galaxy  string               `sereal:"galaxy"`
+	Age     int                  `sereal:"age"`
+	Stars   []string             `sereal:"stars"`
+	Planets []RefPlanet          `sereal:"planets"`
+	ByName  map[string]RefPlanet `sereal:"by_name,omitempty"`
+	Masses  map[string]float64   `sereal:"masses,omitempty"`
+	Rings   []bool               `sereal:"rings,omitempty"`
+	Photos  [][]byte             `sereal:"photos,omitempty"`
+}
+
+func newGenRequest() GenRequest {
+	return GenRequest{
+		GenBase: GenBase{Trace: "4bf92f35"},
+		ID:      -1234567,
+		Method:  "users.search",
+		Params:  map[string]interface{}{"query": "name:Foo*"},
+		Tags:    []string{"search", "users"},
+		Limit:   10,
+		Ratio:   0.5,
+		Score:   2.5,
+		Active:  true,
+		Count:   42,
+		Body:    []byte("body"),
+		Note:    "note",
+		Raw:     []byte("raw"),
+		Client:  GenClient{"sereal-test", 3},
+	}
+}
+
+func newGenSolarSystem() GenSolarSystem {
+	var planets []GenPlanet
+	for _, p := range solarSystemPlanets() {
+		planets = append(planets, GenPlanet(p))
+	}
+
+	return GenSolarSystem{
+		Galaxy:  "Milky Way",
+		Age:     4568,
+		Stars:   []string{"Sun"},
+		Planets: planets,
+	}
+}
+
+// refSolarSystem returns the reflection based twin of s, sharing its slices
+// and maps of predeclared types
+func refSolarSystem(s *GenSolarSystem) *RefSolarSystem {
+	ref := &RefSolarSystem{
+		Galaxy: s.Galaxy,
+		Age:    s.Age,
+		Stars:  s.Stars,
+		Masses: s.Masses,
+		Rings:  s.Rings,
+		Photos: s.Photos,
+	}
+
+	for _, p := range s.Planets {
+		ref.Planets = append(ref.Planets, RefPlanet(p))
+	}
+
+	if s.ByName != nil {
+		ref.ByName = make(map[string]RefPlanet)
+		for k, p := range s.ByName {
+			ref.ByName[k] = RefPlanet(p)
+		}
+	}
+
+	return ref
+}
+
+var serealgenEncoders = map[string]*sereal.Encoder{
+	"default":    sereal.NewEncoderV3(),
+	"perlCompat": {PerlCompat: true},
+	"compact":    {PerlCompat: true, Compact: true},
+	"dedupe":     {AliasedDedupeStrings: true},
+	"unblessed":  {UnblessedStructs: true},
+	"canonical":  {Canonical: true},
+}
+
+func TestSerealgen(t *testing.T) {
+	encoders := serealgenEncoders
+
+	full := newGenRequest()
+	cycle := newGenRequest()
+	cycle.Next = &cycle
+
+	values := []*GenRequest{
+		&full,
+		{Method: "users.next"}, // omitted and empty fields
+		&cycle,
+	}
+
+	for name, e := range encoders {
+		for i, gen := range values {
+			got, err := e.Marshal(gen)
+			if err != nil {
+				t.Fatalf("%s/%d: marshalling generated an error: %v", name, i, err)
+			}
+
+			// the same pointer, so cycles are found in both
+			expected, err := e.Marshal((*RefRequest)(gen))
+			if err != nil {
+				t.Fatalf("%s/%d: marshalling via reflection generated an error: %v", name, i, err)
+			}
+
+			expected = bytes.Replace(expected, []byte("RefRequest"), []byte("GenRequest"), -1)
+			if !bytes.Equal(got, expected) {
+				t.Errorf("%s/%d: generated code encodes differently:\ngot   : %x\nwanted: %x", name, i, got, expected)
+			}
+		}
+
+		got, _ := e.Marshal(full.Client)
+		expected, _ := e.Marshal(RefClient(full.Client))
+		expected = bytes.Replace(expected, []byte("RefClient"), []byte("GenClient"), -1)
+		if !bytes.Equal(got, expected) {
+			t.Errorf("%s: generated code encodes differently:\ngot   : %x\nwanted: %x", name, got, expected)
+		}
+	}
+
+	// unsupported types are found at the same path
+	bad := newGenRequest()
+	bad.Params["done"] = make(chan int)
+	_, err := sereal.Marshal(&bad)
+	_, refErr := sereal.Marshal((*RefRequest)(&bad))
+	if _, ok := err.(*sereal.UnsupportedTypeError); !ok || refErr == nil || err.Error() != refErr.Error() {
+		t.Errorf("got error %v, expected %v", err, refErr)
+	}
+
+	// classes named by tags, and registered ones
+	for _, class := range []string{"MyApp::Event", "MyApp::Model::Event"} {
+		if class != "MyApp::Event" {
+			sereal.RegisterClass(reflect.TypeOf(RefEvent{}), class)
+			sereal.RegisterClass(reflect.TypeOf(GenEvent{}), class)
+		}
+
+		got, _ := sereal.Marshal(&GenEvent{Name: "login"})
+		expected, _ := sereal.Marshal(&RefEvent{Name: "login"})
+		if !bytes.Equal(got, expected) || !bytes.Contains(got, []byte(class)) {
+			t.Errorf("%s: generated code encodes differently:\ngot   : %x\nwanted: %x", class, got, expected)
+		}
+	}
+
+	b, err := sereal.Marshal(&full)
+	if err != nil {
+		t.Fatalf("marshalling generated an error: %v", err)
+	}
+
+	var decoded GenRequest
+	if err := sereal.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("unmarshalling generated an error: %v", err)
+	}
+
+	var refDecoded RefRequest
+	if err := sereal.Unmarshal(b, &refDecoded); err != nil {
+		t.Fatalf("unmarshalling via reflection generated an error: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, GenRequest(refDecoded)) {
+		t.Errorf("generated code decodes differently:\ngot   : %s\nwanted: %s", spew.Sdump(decoded), spew.Sdump(refDecoded))
+	}
+
+	// a nil Next decodes to an empty GenRequest, as it does via reflection
+	decoded.Next = nil
+	if !reflect.DeepEqual(decoded, full) {
+		t.Errorf("generated code doesn't round trip:\ngot   : %s\nwanted: %s", spew.Sdump(decoded), spew.Sdump(full))
+	}
+
+	if b, err = sereal.Marshal(&cycle); err != nil {
+		t.Fatalf("marshalling a cycle generated an error: %v", err)
+	}
+
+	var decodedCycle *GenRequest
+	if err := sereal.Unmarshal(b, &decodedCycle); err != nil {
+		t.Fatalf("unmarshalling a cycle generated an error: %v", err)
+	}
+
+	if decodedCycle.Next != decodedCycle {
+		t.Errorf("cycle not preserved: %s", spew.Sdump(decodedCycle))
+	}
+
+	// the limits of the decoder apply to generated code too
+	full.Next = &GenRequest{Method: "users.next"}
+	if b, err = sereal.Marshal(&full); err != nil {
+		t.Fatalf("marshalling generated an error: %v", err)
+	}
+
+	limits := []*sereal.Decoder{
+		{MaxRecursionDepth: 1},
+		{MaxNumHashEntries: 3},
+		{MaxStringLength: 3},
+	}
+
+	for _, d := range limits {
+		var limited GenRequest
+		if err := d.Unmarshal(b, &limited); err == nil {
+			t.Errorf("%+v: expected a *LimitError", *d)
+		} else if _, ok := err.(*sereal.LimitError); !ok {
+			t.Errorf("%+v: expected a *LimitError, got %v", *d, err)
+		}
+	}
+}
+
+func TestSerealgenContainers(t *testing.T) {
+	full := newGenSolarSystem()
+	earth := full.Planets[2]
+	full.ByName = map[string]GenPlanet{"Earth": earth}
+	full.Masses = map[string]float64{"Earth": earth.MassEarths}
+	full.Rings = []bool{false, false, false, false, true, true, true, true}
+	full.Photos = [][]byte{[]byte("pale blue dot"), nil}
+
+	// shared slices are referred to in both
+	full.Stars = earth.NotableSatellites
+
+	// the order of map entries is only fixed for canonical encoders
+	sorted := newGenSolarSystem()
+	sorted.ByName = make(map[string]GenPlanet)
+	sorted.Masses = make(map[string]float64)
+	for _, p := range sorted.Planets {
+		sorted.ByName[p.Name] = p
+		sorted.Masses[p.Name] = p.MassEarths
+	}
+
+	values := []*GenSolarSystem{&full, {}, &sorted}
+
+	for name, e := range serealgenEncoders {
+		for i, gen := range values {
+			if gen == &sorted && !e.Canonical {
+				continue
+			}
+
+			got, err := e.Marshal(gen)
+			if err != nil {
+				t.Fatalf("%s/%d: marshalling generated an error: %v", name, i, err)
+			}
+
+			expected, err := e.Marshal(refSolarSystem(gen))
+			if err != nil {
+				t.Fatalf("%s/%d: marshalling via reflection generated an error: %v", name, i, err)
+			}
+
+			expected = bytes.Replace(expected, []byte("RefSolarSystem"), []byte("GenSolarSystem"), -1)
+			expected = bytes.Replace(expected, []byte("RefPlanet"), []byte("GenPlanet"), -1)
+			if !bytes.Equal(got, expected) {
+				t.Errorf("%s/%d: generated code encodes differently:\ngot   : %x\nwanted: %x", name, i, got, expected)
+			}
+		}
+	}
+
+	// unsupported types are found at the same path within containers
+	e := sereal.NewEncoderV3()
+	badEarth := func(v reflect.Value) (interface{}, error) {
+		if v.FieldByName("Name").String() == "Earth" {
+			return make(chan int), nil
+		}
+		return v.FieldByName("Name").String(), nil
+	}
+	e.RegisterType(reflect.TypeOf(GenPlanet{}), badEarth)
+	e.RegisterType(reflect.TypeOf(RefPlanet{}), badEarth)
+
+	for _, path := range []string{".planets[2]", `.by_name["Earth"]`} {
+		bad := newGenSolarSystem()
+		if path != ".planets[2]" {
+			bad.Planets = nil
+			bad.ByName = map[string]GenPlanet{"Earth": full.Planets[2]}
+		}
+
+		_, err := e.Marshal(&bad)
+		_, refErr := e.Marshal(refSolarSystem(&bad))
+		if ute, ok := err.(*sereal.UnsupportedTypeError); !ok || refErr == nil || err.Error() != refErr.Error() || ute.Path != path {
+			t.Errorf("got error %v, expected %v at %s", err, refErr, path)
+		}
+	}
+}
+
+// countingWriter counts the writes to it, failing once there were fail of them
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+	fail   int
+}
+
+var errCountingWrite = errors.New("write failed")
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.fail > 0 && w.writes == w.fail {
+		return 0, errCountingWrite
+	}
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestSerealgenEncodeStream(t *testing.T) {
+	in := newGenSolarSystem()
+	in.Stars = make([]string, 10000)
+	for i := range in.Stars {
+		in.Stars[i] = "star #" + strconv.Itoa(i)
+	}
+
+	e := sereal.NewEncoderV3()
+
+	// the header, the final part of the body, and the body as it grew
+	var w countingWriter
+	if err := e.Encode(&w, nil, &in); err != nil {
+		t.Fatalf("encoding generated an error: %v", err)
+	}
+	if w.writes <= 2 {
+		t.Errorf("a %d byte document was written in %d writes", w.Len(), w.writes)
+	}
+
+	var out GenSolarSystem
+	if err := sereal.NewDecoder().Unmarshal(w.Bytes(), &out); err != nil {
+		t.Fatalf("decoding generated an error: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("bad roundtrip: got %s", spew.Sdump(out))
+	}
+
+	// failing writes in the middle of the body
+	if err := e.Encode(&countingWriter{fail: 2}, nil, &in); err != errCountingWrite {
+		t.Errorf("expected a write error, got %v", err)
+	}
+}
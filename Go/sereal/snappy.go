@@ -27,12 +27,34 @@ func (c SnappyCompressor) compress(b []byte) ([]byte, error) {
 	return b, nil
 }
 
-func (c SnappyCompressor) decompress(b []byte) ([]byte, error) {
+func (c SnappyCompressor) decompress(b []byte, max int) ([]byte, error) {
 	if c.Incremental {
-		ln, sz := varintdecode(b)
+		ln, sz, err := readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+		if ln < 0 || ln > len(b)-sz {
+			return nil, ErrTruncated
+		}
 		b = b[sz : sz+ln]
 	}
 
+	// the block starts with the uncompressed length, which the decoder
+	// allocates up front
+	uln, _, err := readVarint(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// snappy can't do better than a 64 byte copy in 3 bytes
+	if uln < 0 || uln/22 > len(b) {
+		return nil, ErrCorrupt{errBadUncompressedSize}
+	}
+
+	if err := checkLimit(ErrMaxUncompressedSize, max, uln); err != nil {
+		return nil, err
+	}
+
 	decompressed, err := snappyDecode(nil, b)
 	if err != nil {
 		return nil, err
@@ -40,3 +62,68 @@ func (c SnappyCompressor) decompress(b []byte) ([]byte, error) {
 
 	return decompressed, nil
 }
+
+// snappyBlockLength returns the length of the snappy compressed block at the
+// start of b.  Non-incremental documents don't store it, so the block is
+// walked until all of the uncompressed data is accounted for.
+func snappyBlockLength(b []byte) (int, error) {
+	uln, idx, err := readVarint(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for uln > 0 {
+		if idx >= len(b) {
+			return 0, ErrTruncated
+		}
+
+		tag := b[idx]
+		idx++
+
+		var ln int
+
+		switch tag & 0x03 {
+		case 0x00: // literal
+			ln = int(tag >> 2)
+			if ln >= 60 {
+				// length-1 is stored in the next 1-4 bytes
+				n := ln - 59
+				if idx+n > len(b) {
+					return 0, ErrTruncated
+				}
+
+				ln = 0
+				for i := n - 1; i >= 0; i-- {
+					ln = ln<<8 | int(b[idx+i])
+				}
+				idx += n
+			}
+			ln++
+			idx += ln
+
+		case 0x01: // copy with 1-byte offset
+			ln = 4 + int(tag>>2)&0x07
+			idx++
+
+		case 0x02: // copy with 2-byte offset
+			ln = 1 + int(tag>>2)
+			idx += 2
+
+		case 0x03: // copy with 4-byte offset
+			ln = 1 + int(tag>>2)
+			idx += 4
+		}
+
+		if idx > len(b) {
+			return 0, ErrTruncated
+		}
+
+		if ln > uln {
+			return 0, ErrCorrupt{errBadSliceSize}
+		}
+
+		uln -= ln
+	}
+
+	return idx, nil
+}
@@ -0,0 +1,472 @@
+package sereal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+)
+
+// streamBufferSize is the amount of encoded body data buffered by Encode
+// before it is written out
+const streamBufferSize = 32 * 1024
+
+// streamWriter holds the state of an in-progress streamed document body.
+//
+// Offsets stored in the string and pointer tables are positions in the
+// document (v1) or document body (v2 and up), so they have to account for
+// everything that has already been written out: the offset of by[i] is base+i.
+type streamWriter struct {
+	w       io.Writer
+	base    int   // offset of the first buffered byte
+	pending []int // offsets of tags which must be tracked once flushed
+}
+
+// Encode writes the Sereal encoding of body with header data to w.
+//
+// Uncompressed documents are written progressively, buffering at most a few
+// tens of kilobytes of the body at a time.  Since already written bytes can't
+// be patched, every reference which may later be the target of a REFP is
+// emitted with the track flag set.  Compressed documents need the whole body
+// before compression, so they are built in memory and written out at once.
+//
+// Decoders can't tell those eagerly tracked references from ones which really
+// are referenced again.  Without PerlCompat they decode the same as the
+// output of MarshalWithHeader, but a PerlCompat Decoder turns every tracked
+// REFN into an *interface{} holding the referenced value, where it would
+// otherwise be a pointer of the value's own type, e.g. *int.  Use
+// MarshalWithHeader when documents are decoded that way and the pointer types
+// matter.
+func (e *Encoder) Encode(w io.Writer, header interface{}, body interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+
+			if s, ok := r.(string); ok {
+				err = errors.New(s)
+			} else {
+				err = r.(error)
+			}
+		}
+	}()
+
+	if e.Compression != nil {
+		b, err := e.MarshalWithHeader(header, body)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(b)
+		return err
+	}
+
+	// uninitialized encoder? set to the most recent supported protocol version
+	if e.version == 0 {
+		e.version = ProtocolVersion
+	}
+
+	var encHeader []byte
+	if header != nil && e.version >= 2 {
+		hs := e.newSession()
+		defer hs.release()
+
+		if encHeader, err = hs.encodeHeaderSuffix(header); err != nil {
+			return err
+		}
+	}
+
+	se := e.newSession()
+	defer se.release()
+
+	st := se.state
+	se.stream = &streamWriter{w: w}
+
+	encBody := e.appendHeader(st.buf[:0], encHeader, serealRaw)
+	if _, err = w.Write(encBody); err != nil {
+		return err
+	}
+
+	if se.version == 1 {
+		// v1 offsets are relative to the start of the document
+		se.stream.base = len(encBody)
+	} else {
+		// v2 offsets are 1-based
+		se.stream.base = 1
+	}
+
+	encBody = encBody[:0]
+
+	encBody, err = se.encode(encBody, body, false, false, st.strTable, st.ptrTable, st.objTable)
+	if err != nil {
+		return err
+	}
+
+	st.buf = encBody
+	_, err = se.stream.flush(encBody)
+	return err
+}
+
+// maybeFlush writes out the buffered part of a streamed document body once
+// it grows past streamBufferSize
+func (e *Encoder) maybeFlush(by []byte) ([]byte, error) {
+	if e.stream == nil || len(by) < streamBufferSize {
+		return by, nil
+	}
+
+	return e.stream.flush(by)
+}
+
+func (s *streamWriter) flush(by []byte) ([]byte, error) {
+	// tags waiting for their track flag have all been emitted by now
+	for _, offs := range s.pending {
+		by[offs-s.base] |= trackFlag
+	}
+	s.pending = s.pending[:0]
+
+	if _, err := s.w.Write(by); err != nil {
+		return nil, err
+	}
+
+	s.base += len(by)
+
+	return by[:0], nil
+}
+
+// popPending sets the track flag on the most recently pended tag if it hasn't
+// been flushed in the meantime, in which case flush took care of it already
+func (s *streamWriter) popPending(by []byte) []byte {
+	if l := len(s.pending); l > 0 {
+		offs := s.pending[l-1]
+		s.pending = s.pending[:l-1]
+		by[offs-s.base] |= trackFlag
+	}
+
+	return by
+}
+
+// A StreamDecoder reads and decodes consecutive Sereal documents from an input
+// stream.  The options of the embedded Decoder apply to every document;
+// MaxDocumentSize caps the data buffered for one, for streams from untrusted
+// sources.
+type StreamDecoder struct {
+	Decoder
+	r   io.Reader
+	buf []byte // data read from r but not yet consumed
+}
+
+// streamReadSize is the minimum amount of data requested from the underlying reader
+const streamReadSize = 4096
+
+// NewStreamDecoder returns a StreamDecoder with default flags reading from r
+func NewStreamDecoder(r io.Reader) *StreamDecoder {
+	return &StreamDecoder{r: r}
+}
+
+// Decode reads the next Sereal document from the stream and extracts the
+// header and body data into vheader and vbody, respectively.
+//
+// Raw and non-incremental snappy bodies carry no length, so they are parsed to
+// find where the document ends; other compressed bodies are framed by their
+// compressed length.  Decode
+// returns io.EOF when the stream ends between two documents and ErrTruncated
+// when it ends in the middle of one.
+func (s *StreamDecoder) Decode(vheader interface{}, vbody interface{}) error {
+	if err := s.fill(1); err != nil {
+		if err == ErrTruncated {
+			return io.EOF
+		}
+		return err
+	}
+
+	ln, err := s.documentLength()
+	if err != nil {
+		return err
+	}
+
+	// limit the capacity so decompression can't scribble over the next document
+	err = s.Decoder.UnmarshalHeaderBody(s.buf[:ln:ln], vheader, vbody)
+
+	// the document is framed, so move on to the next one even on failure
+	s.buf = s.buf[:copy(s.buf, s.buf[ln:])]
+
+	return err
+}
+
+// documentLength reads enough of the stream to hold the next document and
+// returns its length
+func (s *StreamDecoder) documentLength() (int, error) {
+	if err := s.fill(headerSize + 1); err != nil {
+		return 0, err
+	}
+
+	ln, sz, err := s.varintAt(headerSize)
+	if err != nil {
+		return 0, err
+	}
+
+	bodyStart := headerSize + sz + ln
+	if err := s.fill(bodyStart); err != nil {
+		return 0, err
+	}
+
+	header, err := readHeader(s.buf)
+	if err != nil {
+		return 0, err
+	}
+
+	switch header.doctype {
+	case serealRaw:
+		sc := bodyScanner{items: 1}
+		for {
+			ln, err := sc.scan(s.buf[bodyStart:])
+			if err == nil {
+				return bodyStart + ln, nil
+			}
+
+			if err != ErrTruncated {
+				return 0, err
+			}
+
+			if err := s.fill(len(s.buf) + 1); err != nil {
+				return 0, err
+			}
+		}
+
+	case serealSnappyIncremental:
+		ln, sz, err := s.varintAt(bodyStart)
+		if err != nil {
+			return 0, err
+		}
+		return s.fillLength(bodyStart + sz + ln)
+
+	case serealZlib:
+		_, usz, err := s.varintAt(bodyStart)
+		if err != nil {
+			return 0, err
+		}
+
+		cln, csz, err := s.varintAt(bodyStart + usz)
+		if err != nil {
+			return 0, err
+		}
+		return s.fillLength(bodyStart + usz + csz + cln)
+
+	case serealSnappy:
+		for {
+			ln, err := snappyBlockLength(s.buf[bodyStart:])
+			if err == nil {
+				return bodyStart + ln, nil
+			}
+
+			if err != ErrTruncated {
+				return 0, err
+			}
+
+			if err := s.fill(len(s.buf) + 1); err != nil {
+				return 0, err
+			}
+		}
+
+	default:
+		return 0, fmt.Errorf("document type '%d' not yet supported", header.doctype)
+	}
+}
+
+func (s *StreamDecoder) fillLength(n int) (int, error) {
+	if n < 0 || n > math.MaxInt32 {
+		return 0, ErrCorrupt{errBadSliceSize}
+	}
+
+	if err := s.fill(n); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// varintAt reads the varint at offset idx of the buffered data
+func (s *StreamDecoder) varintAt(idx int) (int, int, error) {
+	for {
+		n, sz, err := readVarint(s.buf[idx:])
+		if err != ErrTruncated {
+			return n, sz, err
+		}
+
+		if err := s.fill(len(s.buf) + 1); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// fill reads from the stream until at least n bytes of the next document are
+// buffered, refusing documents larger than MaxDocumentSize.  n comes from the
+// document itself, so the buffer grows with the data actually read rather than
+// being sized up front for whatever the stream claims.
+func (s *StreamDecoder) fill(n int) error {
+	if err := checkLimit(ErrMaxDocumentSize, s.MaxDocumentSize, n); err != nil {
+		return err
+	}
+
+	for len(s.buf) < n {
+		if len(s.buf) == cap(s.buf) {
+			// double the buffer, so refilling one byte at a time stays linear
+			grow := len(s.buf)
+			if grow < streamReadSize {
+				grow = streamReadSize
+			}
+			buf := make([]byte, len(s.buf), len(s.buf)+grow)
+			copy(buf, s.buf)
+			s.buf = buf
+		}
+
+		m, err := s.r.Read(s.buf[len(s.buf):cap(s.buf)])
+		s.buf = s.buf[:len(s.buf)+m]
+
+		if err == io.EOF {
+			if len(s.buf) >= n {
+				return nil
+			}
+			return ErrTruncated
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bodyLength returns the length of the raw document body at the start of b,
+// or ErrTruncated if b doesn't hold all of it
+func bodyLength(b []byte) (int, error) {
+	sc := bodyScanner{items: 1}
+	return sc.scan(b)
+}
+
+// bodyScanner walks the tags of a raw document body to find where it ends.
+// When the body is truncated, a later call to scan with more data resumes
+// after the last complete tag.
+type bodyScanner struct {
+	idx   int // offset of the next tag
+	items int // number of items still to be read
+}
+
+func (sc *bodyScanner) scan(b []byte) (int, error) {
+	for sc.items > 0 {
+		idx := sc.idx
+		items := sc.items
+
+		if idx >= len(b) {
+			return 0, ErrTruncated
+		}
+
+		tag := b[idx] &^ trackFlag
+		idx++
+		items--
+
+		switch {
+		case tag < typeVARINT, tag == typeUNDEF, tag == typeCANONICAL_UNDEF, tag == typeTRUE, tag == typeFALSE:
+			// no payload
+
+		case tag == typePAD:
+			// padding isn't an item
+			items++
+
+		case tag == typeREFN, tag == typeWEAKEN:
+			items++
+
+		case tag == typeFLOAT:
+			idx += 4
+
+		case tag == typeDOUBLE:
+			idx += 8
+
+		case tag == typeLONG_DOUBLE:
+			idx += 16
+
+		case tag == typeVARINT, tag == typeZIGZAG, tag == typeREFP, tag == typeALIAS, tag == typeCOPY:
+			_, sz, err := readVarint(b[idx:])
+			if err != nil {
+				return 0, err
+			}
+			idx += sz
+
+		case tag == typeOBJECTV, tag == typeOBJECTV_FREEZE:
+			_, sz, err := readVarint(b[idx:])
+			if err != nil {
+				return 0, err
+			}
+			idx += sz
+			items++ // object item
+
+		case tag == typeOBJECT, tag == typeOBJECT_FREEZE, tag == typeREGEXP:
+			items += 2 // class and object item, or pattern and modifiers
+
+		case tag == typeBINARY, tag == typeSTR_UTF8, tag == typeARRAY, tag == typeHASH:
+			ln, sz, err := readVarint(b[idx:])
+			if err != nil {
+				return 0, err
+			}
+			idx += sz
+
+			if ln < 0 || ln > math.MaxInt32 {
+				return 0, ErrCorrupt{errBadSliceSize}
+			}
+
+			switch tag {
+			case typeBINARY, typeSTR_UTF8:
+				idx += ln
+			case typeARRAY:
+				items += ln
+			case typeHASH:
+				items += 2 * ln
+			}
+
+		case tag >= typeARRAYREF_0 && tag < typeARRAYREF_0+16:
+			items += int(tag & 0x0f)
+
+		case tag >= typeHASHREF_0 && tag < typeHASHREF_0+16:
+			items += 2 * int(tag&0x0f)
+
+		case tag >= typeSHORT_BINARY_0 && tag < typeSHORT_BINARY_0+32:
+			idx += int(tag & 0x1f)
+
+		default:
+			return 0, ErrUnknownTag
+		}
+
+		if idx > len(b) {
+			return 0, ErrTruncated
+		}
+
+		sc.idx = idx
+		sc.items = items
+	}
+
+	return sc.idx, nil
+}
+
+// readVarint decodes the varint at the start of by, returning ErrTruncated
+// for one cut short by the end of by
+func readVarint(by []byte) (n int, sz int, err error) {
+	s := uint(0) // shift count
+	for i, b := range by {
+		n |= int(b&0x7f) << s
+		s += 7
+
+		if (b & 0x80) == 0 {
+			return n, i + 1, nil
+		}
+
+		if s > 63 {
+			// too many continuation bits
+			return 0, 0, ErrCorrupt{errBadVarint}
+		}
+	}
+
+	return 0, 0, ErrTruncated
+}
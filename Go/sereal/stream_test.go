@@ -0,0 +1,347 @@
+package sereal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestEncodeStream(t *testing.T) {
+
+	manydups := make([]interface{}, 10000)
+	for i := 0; i < len(manydups); i++ {
+		manydups[i] = []interface{}{"hello, world " + strconv.Itoa(i), i}
+	}
+
+	for _, version := range []int{1, 2, 3} {
+		e := &Encoder{version: version}
+
+		expected, err := e.MarshalWithHeader("header", manydups)
+		if err != nil {
+			t.Fatalf("v%d: marshalling generated an error: %v", version, err)
+		}
+
+		var buf bytes.Buffer
+		if err := e.Encode(&buf, "header", manydups); err != nil {
+			t.Fatalf("v%d: encoding generated an error: %v", version, err)
+		}
+
+		if len(expected) < 2*streamBufferSize {
+			t.Fatalf("v%d: test document too small to be flushed: %d bytes", version, len(expected))
+		}
+
+		// containers are tracked eagerly when streaming, which only
+		// changes their track flags
+		got := buf.Bytes()
+		if len(expected) != len(got) {
+			t.Fatalf("v%d: streamed document differs from marshalled one", version)
+		}
+
+		for i := range expected {
+			if expected[i] != got[i] && expected[i]|trackFlag != got[i] {
+				t.Fatalf("v%d: streamed document differs from marshalled one at offset %d", version, i)
+			}
+		}
+	}
+}
+
+func TestEncodeStreamPointers(t *testing.T) {
+
+	type node struct {
+		Name  string
+		Items []string
+	}
+
+	items := make([]string, 5000)
+	for i := 0; i < len(items); i++ {
+		items[i] = "item " + strconv.Itoa(i)
+	}
+
+	shared := &node{"shared", items}
+	sharedItems := &items
+
+	body := []interface{}{shared, sharedItems, shared, sharedItems}
+
+	for _, perlCompat := range []bool{false, true} {
+		e := &Encoder{PerlCompat: perlCompat, version: 3}
+		d := &Decoder{PerlCompat: perlCompat}
+
+		expected, err := e.Marshal(body)
+		if err != nil {
+			t.Fatalf("perlCompat=%t: marshalling generated an error: %v", perlCompat, err)
+		}
+
+		var buf bytes.Buffer
+		if err := e.Encode(&buf, nil, body); err != nil {
+			t.Fatalf("perlCompat=%t: encoding generated an error: %v", perlCompat, err)
+		}
+
+		var want, got interface{}
+		if err := d.Unmarshal(expected, &want); err != nil {
+			t.Fatalf("perlCompat=%t: decoding marshalled document: %v", perlCompat, err)
+		}
+
+		if err := d.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("perlCompat=%t: decoding streamed document: %v", perlCompat, err)
+		}
+
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("perlCompat=%t: streamed document decodes differently", perlCompat)
+		}
+	}
+}
+
+func TestEncodeStreamPerlCompatRefs(t *testing.T) {
+
+	i := 5
+	body := []interface{}{&i, "unreferenced"}
+
+	e := &Encoder{PerlCompat: true, version: 3}
+	d := &Decoder{PerlCompat: true}
+
+	expected, err := e.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := e.Encode(&buf, nil, body); err != nil {
+		t.Fatal(err)
+	}
+
+	// in PerlCompat mode arrays are references
+	var wantRef, gotRef *[]interface{}
+	if err := d.Unmarshal(expected, &wantRef); err != nil {
+		t.Fatalf("decoding marshalled document: %v", err)
+	}
+
+	if err := d.Unmarshal(buf.Bytes(), &gotRef); err != nil {
+		t.Fatalf("decoding streamed document: %v", err)
+	}
+
+	want, got := *wantRef, *gotRef
+
+	// the REFN of a streamed pointer is always tracked, see Encode
+	if p, ok := want[0].(*int); !ok || *p != 5 {
+		t.Errorf("marshalled pointer decoded as %#v, expected *int", want[0])
+	}
+
+	if p, ok := got[0].(*interface{}); !ok || *p != 5 {
+		t.Errorf("streamed pointer decoded as %#v, expected *interface{}", got[0])
+	}
+
+	if !reflect.DeepEqual(want[1:], got[1:]) {
+		t.Errorf("streamed scalars decode differently: got %#v, expected %#v", got[1:], want[1:])
+	}
+}
+
+func TestEncodeStreamCompressed(t *testing.T) {
+
+	e := NewEncoderV3()
+	e.Compression = ZlibCompressor{}
+	e.CompressionThreshold = 0
+
+	body := []interface{}{"hello, world", 1, 2, 3, []interface{}{"hello, world"}}
+
+	expected, err := e.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := e.Encode(&buf, nil, body); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(expected, buf.Bytes()) {
+		t.Errorf("compressed streamed document differs from marshalled one")
+	}
+}
+
+type errWriter struct{ n int }
+
+var errWrite = errors.New("write failed")
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	if w.n <= 0 {
+		return 0, errWrite
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestEncodeStreamWriteError(t *testing.T) {
+
+	big := make([]string, 10000)
+	for i := 0; i < len(big); i++ {
+		big[i] = "hello, world " + strconv.Itoa(i)
+	}
+
+	e := NewEncoderV3()
+
+	// fail on the header and on the first body flush
+	for n := 0; n < 2; n++ {
+		if err := e.Encode(&errWriter{n}, nil, big); err != errWrite {
+			t.Errorf("write #%d: expected write error, got %v", n, err)
+		}
+	}
+}
+
+func TestStreamDecoder(t *testing.T) {
+
+	type doc struct {
+		header interface{}
+		body   interface{}
+	}
+
+	big := make([]interface{}, 5000)
+	for i := 0; i < len(big); i++ {
+		big[i] = "hello, world " + strconv.Itoa(i%10)
+	}
+
+	docs := []doc{
+		{nil, "hello"},
+		{map[string]interface{}{"type": "web"}, roundtrips},
+		{"header", big},
+		{nil, map[string]interface{}{"foo": []interface{}{1, 2, 3}}},
+	}
+
+	encoders := []*Encoder{
+		NewEncoderV3(),
+		&Encoder{version: 1, Compression: SnappyCompressor{Incremental: false}},
+		&Encoder{version: 3, Compression: SnappyCompressor{Incremental: true}},
+		&Encoder{version: 3, Compression: ZlibCompressor{}},
+	}
+
+	var stream bytes.Buffer
+	for i, e := range encoders {
+		for j, d := range docs {
+			if err := e.Encode(&stream, d.header, d.body); err != nil {
+				t.Fatalf("encoder #%d, document #%d: encoding generated an error: %v", i, j, err)
+			}
+		}
+	}
+
+	// read a byte at a time to exercise refilling the buffer
+	d := NewStreamDecoder(&oneByteReader{bytes.NewReader(stream.Bytes())})
+
+	for i, e := range encoders {
+		for j, expected := range docs {
+			var header, body interface{}
+			if err := d.Decode(&header, &body); err != nil {
+				t.Fatalf("encoder #%d, document #%d: decoding generated an error: %v", i, j, err)
+			}
+
+			// v1 documents don't carry a header
+			if e.version > 1 && expected.header != nil && !reflect.DeepEqual(expected.header, header) {
+				t.Errorf("encoder #%d, document #%d: bad header: got %#v", i, j, header)
+			}
+
+			if !reflect.DeepEqual(expected.body, body) {
+				t.Errorf("encoder #%d, document #%d: bad body", i, j)
+			}
+		}
+	}
+
+	var body interface{}
+	if err := d.Decode(nil, &body); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestStreamDecoderTruncated(t *testing.T) {
+
+	e := NewEncoderV3()
+	b, err := e.Marshal(roundtrips)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < len(b); i++ {
+		d := NewStreamDecoder(bytes.NewReader(b[:i]))
+
+		var body interface{}
+		if err := d.Decode(nil, &body); err != ErrTruncated {
+			t.Errorf("stream truncated at %d: expected ErrTruncated, got %v", i, err)
+		}
+	}
+}
+
+func TestStreamDecoderLimits(t *testing.T) {
+
+	big := make([]interface{}, 1000)
+	for i := range big {
+		big[i] = "hello, world"
+	}
+
+	var raw bytes.Buffer
+	if err := NewEncoderV3().Encode(&raw, nil, big); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		what string
+		b    []byte
+	}{
+		// a header suffix claiming 1GB
+		{"header", []byte{0x3d, 0xf3, 0x72, 0x6c, 3, 0x80, 0x80, 0x80, 0x80, 0x04}},
+		// an incremental snappy body claiming 1GB
+		{"snappy", []byte{0x3d, 0xf3, 0x72, 0x6c, 3 | byte(serealSnappyIncremental)<<4, 0, 0x80, 0x80, 0x80, 0x80, 0x04}},
+		// a zlib body claiming 1GB, once compressed
+		{"zlib", []byte{0x3d, 0xf3, 0x72, 0x6c, 3 | byte(serealZlib)<<4, 0, 1, 0x80, 0x80, 0x80, 0x80, 0x04}},
+		{"raw body", raw.Bytes()},
+	}
+
+	for _, tt := range tests {
+		d := NewStreamDecoder(bytes.NewReader(tt.b))
+		d.MaxDocumentSize = 1000
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		var body interface{}
+		err := d.Decode(nil, &body)
+		runtime.ReadMemStats(&after)
+
+		if !errors.Is(err, ErrMaxDocumentSize) {
+			t.Errorf("%s: expected ErrMaxDocumentSize, got %v", tt.what, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%s: decoding %d bytes allocated %d bytes", tt.what, len(tt.b), allocated)
+		}
+	}
+}
+
+func TestStreamDecoderClaimedLength(t *testing.T) {
+
+	// a header suffix claiming 1GB, cut short by the end of the stream once
+	// the buffer had to grow
+	b := []byte{0x3d, 0xf3, 0x72, 0x6c, 3, 0x80, 0x80, 0x80, 0x80, 0x04}
+	b = append(b, make([]byte, 2*streamReadSize)...)
+	d := NewStreamDecoder(bytes.NewReader(b))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var body interface{}
+	err := d.Decode(nil, &body)
+	runtime.ReadMemStats(&after)
+
+	if err != ErrTruncated {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("decoding %d bytes allocated %d bytes", len(b), allocated)
+	}
+}
+
+type oneByteReader struct{ r io.Reader }
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
@@ -22,183 +22,19 @@ sub slurp {
     return $d;
 }
 
-# Some parts of the Sereal specification (like aliases) are deliberately not
-# implemented in Go. As a result a set of tests checking omitted functionality
-# will fail. To reduce a level of false negatives here we list names of all
-# tests that are supposed to fail and skip them later.
+# Some documents can't be represented by Go values: scalars referring to each
+# other via references to the array elements holding them. As a result the
+# tests checking them will fail. To reduce a level of false negatives here we
+# list names of all tests that are supposed to fail and skip them later.
 #
 # Multiple original tests share the same name making the following list not
 # 100% reliable and accurate. To mitigate it we also maintain a counter holding
 # a total number of tests to be skipped.
 #
-my $skip_total = 173;
+my $skip_total = 2;
 my %skip = map { $_ => 1 } (
-    'array ref to aliases blessed array',
-    'array ref to aliases complex hash',
-    'array ref to aliases deep nest',
-    'array ref to aliases double ref to foo',
-    'array ref to aliases empty hash',
-    'array ref to aliases empty string',
-    'array ref to aliases eng-ref',
-    'array ref to aliases escaped string',
-    'array ref to aliases float',
-    'array ref to aliases integer: -1',
-    'array ref to aliases integer: -127',
-    'array ref to aliases integer: -128',
-    'array ref to aliases integer: -129',
-    'array ref to aliases integer: -2147483647',
-    'array ref to aliases integer: -2147483648',
-    'array ref to aliases integer: -2147483649',
-    'array ref to aliases integer: -9223372036854775807',
-    'array ref to aliases integer: -9223372036854775808',
-    'array ref to aliases integer: 0',
-    'array ref to aliases integer: 0e0',
-    'array ref to aliases integer: 0e1',
-    'array ref to aliases integer: 1',
-    'array ref to aliases integer: 11285066962739960988',
-    'array ref to aliases integer: 126',
-    'array ref to aliases integer: 127',
-    'array ref to aliases integer: 128',
-    'array ref to aliases integer: 129',
-    'array ref to aliases integer: 18446744073709551614',
-    'array ref to aliases integer: 18446744073709551615',
-    'array ref to aliases integer: 1e3',
-    'array ref to aliases integer: 2147483646',
-    'array ref to aliases integer: 2147483647',
-    'array ref to aliases integer: 2147483648',
-    'array ref to aliases integer: 2147483649',
-    'array ref to aliases integer: 254',
-    'array ref to aliases integer: 255',
-    'array ref to aliases integer: 256',
-    'array ref to aliases integer: 257',
-    'array ref to aliases integer: 3735928559',
-    'array ref to aliases integer: 42',
-    'array ref to aliases integer: 4294967295',
-    'array ref to aliases integer: 9223372036854775806',
-    'array ref to aliases integer: 9223372036854775807',
-    'array ref to aliases integer: 9223372036854775808',
-    'array ref to aliases largeish int',
-    'array ref to aliases largeish negative int',
-    'array ref to aliases long ascii string',
-    'array ref to aliases long latin1 string',
-    'array ref to aliases long utf8 string with only ascii',
-    'array ref to aliases long utf8 string with only latin1 subset',
-    'array ref to aliases long utf8 string',
-    'array ref to aliases more complex',
-    'array ref to aliases more escapes',
-    'array ref to aliases negative big num',
-    'array ref to aliases negative float',
-    'array ref to aliases negative small float',
-    'array ref to aliases nested simple',
-    'array ref to aliases positive big num',
-    'array ref to aliases quote keys',
-    'array ref to aliases ref to foo',
-    'array ref to aliases ref to undef',
-    'array ref to aliases reffy hash',
-    'array ref to aliases refy array',
-    'array ref to aliases regexp with inline modifiers',
-    'array ref to aliases regexp with modifiers',
-    'array ref to aliases short ascii string',
-    'array ref to aliases short latin1 string',
-    'array ref to aliases short utf8 string',
-    'array ref to aliases simple array',
-    'array ref to aliases simple hash',
-    'array ref to aliases simple regexp',
-    'array ref to aliases small float',
-    'array ref to aliases small int',
-    'array ref to aliases small negative int',
-    'array ref to aliases undef value',
-    'array ref to aliases undef',
-    'array ref to aliases utf8 string',
-    'array ref to aliases var strings',
-    "array ref to aliases largeish negative int -302001",
-    "array ref to aliases largeish negative int -1234567",
-    "array ref to aliases largeish negative int -12345678",
-    "array ref to aliases long ascii string 'a' x 9999",
-    "array ref to aliases long ascii string 'a' x 10000",
-    "array ref to aliases long ascii string 'a' x 10001",
-    "array ref to aliases long ascii string 'a' x 1023",
-    "array ref to aliases long ascii string 'a' x 1024",
-    "array ref to aliases long ascii string 'a' x 1025",
-    "array ref to aliases long ascii string 'a' x 8191",
-    "array ref to aliases long ascii string 'a' x 8192",
-    "array ref to aliases long ascii string 'a' x 8193",
-    "array ref to aliases long ascii string 'ab' x 9999",
-    "array ref to aliases long ascii string 'ab' x 10000",
-    "array ref to aliases long ascii string 'ab' x 10001",
-    "array ref to aliases long ascii string 'ab' x 1023",
-    "array ref to aliases long ascii string 'ab' x 1024",
-    "array ref to aliases long ascii string 'ab' x 1025",
-    "array ref to aliases long ascii string 'ab' x 8191",
-    "array ref to aliases long ascii string 'ab' x 8192",
-    "array ref to aliases long ascii string 'ab' x 8193",
-    "array ref to aliases long ascii string 'abc' x 9999",
-    "array ref to aliases long ascii string 'abc' x 10000",
-    "array ref to aliases long ascii string 'abc' x 10001",
-    "array ref to aliases long ascii string 'abc' x 1023",
-    "array ref to aliases long ascii string 'abc' x 1024",
-    "array ref to aliases long ascii string 'abc' x 1025",
-    "array ref to aliases long ascii string 'abc' x 8191",
-    "array ref to aliases long ascii string 'abc' x 8192",
-    "array ref to aliases long ascii string 'abc' x 8193",
-    "array ref to aliases long ascii string 'abcd' x 9999",
-    "array ref to aliases long ascii string 'abcd' x 10000",
-    "array ref to aliases long ascii string 'abcd' x 10001",
-    "array ref to aliases long ascii string 'abcd' x 1023",
-    "array ref to aliases long ascii string 'abcd' x 1024",
-    "array ref to aliases long ascii string 'abcd' x 1025",
-    "array ref to aliases long ascii string 'abcd' x 8191",
-    "array ref to aliases long ascii string 'abcd' x 8192",
-    "array ref to aliases long ascii string 'abcd' x 8193",
-    'array ref to scalar refs to same largeish negative int -302001',
-    'array ref to scalar refs to same largeish negative int -1234567',
-    'array ref to scalar refs to same largeish negative int -12345678',
-    'array ref to scalar refs to same float',
-    'array ref to scalar refs to same integer: -1',
-    'array ref to scalar refs to same integer: -127',
-    'array ref to scalar refs to same integer: -128',
-    'array ref to scalar refs to same integer: -129',
-    'array ref to scalar refs to same integer: -2147483647',
-    'array ref to scalar refs to same integer: -2147483648',
-    'array ref to scalar refs to same integer: -2147483649',
-    'array ref to scalar refs to same integer: -9223372036854775807',
-    'array ref to scalar refs to same integer: -9223372036854775808',
-    'array ref to scalar refs to same integer: 0',
-    'array ref to scalar refs to same integer: 1',
-    'array ref to scalar refs to same integer: 11285066962739960988',
-    'array ref to scalar refs to same integer: 126',
-    'array ref to scalar refs to same integer: 127',
-    'array ref to scalar refs to same integer: 128',
-    'array ref to scalar refs to same integer: 129',
-    'array ref to scalar refs to same integer: 18446744073709551614',
-    'array ref to scalar refs to same integer: 18446744073709551615',
-    'array ref to scalar refs to same integer: 2147483646',
-    'array ref to scalar refs to same integer: 2147483647',
-    'array ref to scalar refs to same integer: 2147483648',
-    'array ref to scalar refs to same integer: 2147483649',
-    'array ref to scalar refs to same integer: 254',
-    'array ref to scalar refs to same integer: 255',
-    'array ref to scalar refs to same integer: 256',
-    'array ref to scalar refs to same integer: 257',
-    'array ref to scalar refs to same integer: 3735928559',
-    'array ref to scalar refs to same integer: 42',
-    'array ref to scalar refs to same integer: 4294967295',
-    'array ref to scalar refs to same integer: 9223372036854775806',
-    'array ref to scalar refs to same integer: 9223372036854775807',
-    'array ref to scalar refs to same integer: 9223372036854775808',
-    'array ref to scalar refs to same largeish int',
-    'array ref to scalar refs to same largeish negative int',
-    'array ref to scalar refs to same negative big num',
-    'array ref to scalar refs to same negative float',
-    'array ref to scalar refs to same negative small float',
-    'array ref to scalar refs to same positive big num',
-    'array ref to scalar refs to same small float',
-    'array ref to scalar refs to same small int',
-    'array ref to scalar refs to same small negative int',
-    'repeated substructure (REFP): scalar ref',
     'scalar cross',
     'weak scalar cross',
-    'weak thing copy (requires PAD)',
 );
 
 my $skipped = 0;
@@ -0,0 +1,277 @@
+package sereal
+
+import (
+	"reflect"
+	"strconv"
+)
+
+// A StructMarshaler writes its own fields, the way the encoder writes structs
+// via reflection.  cmd/serealgen generates implementations, which the encoder
+// prefers to reflection.  Fields of predeclared types such as string or int,
+// and slices and maps of them, are written directly, so types registered with
+// Encoder.RegisterType only apply to struct types and fields written with
+// Value.
+type StructMarshaler interface {
+	MarshalSereal(w *Writer) error
+}
+
+var structMarshalerType = reflect.TypeOf((*StructMarshaler)(nil)).Elem()
+
+// A Writer appends the encoding of a struct to a document.  It is only valid
+// for the duration of the MarshalSereal call it is passed to.
+//
+// A struct is written as an object: BeginObject, followed by a Key and a
+// value for each of its fields.  Slices and maps are written between
+// BeginArray or BeginHash and End, maps with a MapKey before each value, and
+// Flush follows each element so Encoder.Encode can write them out as it goes.
+type Writer struct {
+	e        *Encoder
+	typ      reflect.Type // of the struct being written
+	b        []byte
+	key      string // of the field being written
+	strTable map[string]int
+	ptrTable map[uintptr]int
+	objTable map[string]int
+}
+
+// BeginObject writes the header of a struct with n fields, blessed into class
+// unless another class is registered for the struct's type with
+// RegisterClass, or the encoder writes structs unblessed
+func (w *Writer) BeginObject(class string, n int) {
+	if w.e.UnblessedStructs {
+		class = ""
+	} else if c, ok := registeredClass(w.typ); ok {
+		class = c
+	}
+
+	w.b = w.e.encodeStructHeader(w.b, class, n, w.strTable, w.objTable)
+}
+
+// Key writes the name of the next field
+func (w *Writer) Key(name string) {
+	w.key = name
+	w.b = w.e.encodeString(w.b, name, true, w.strTable)
+}
+
+// String writes a string value
+func (w *Writer) String(s string) {
+	if w.e.DedupeStrings || w.e.AliasedDedupeStrings {
+		w.b = w.e.encodeStringValue(w.b, s, false, false)
+		return
+	}
+
+	w.b = append(w.b, typeSTR_UTF8)
+	w.b = varint(w.b, uint(len(s)))
+	w.b = append(w.b, s...)
+}
+
+// BinaryString writes a string value as binary data
+func (w *Writer) BinaryString(s string) {
+	if w.e.DedupeStrings || w.e.AliasedDedupeStrings {
+		w.b = w.e.encodeStringValue(w.b, s, true, false)
+		return
+	}
+
+	w.binaryHeader(len(s))
+	w.b = append(w.b, s...)
+}
+
+// Binary writes a byte slice value
+func (w *Writer) Binary(b []byte) {
+	if w.e.DedupeStrings || w.e.AliasedDedupeStrings {
+		w.b = w.e.encodeStringValue(w.b, string(b), true, false)
+		return
+	}
+
+	w.binaryHeader(len(b))
+	w.b = append(w.b, b...)
+}
+
+func (w *Writer) binaryHeader(l int) {
+	if l < 32 {
+		w.b = append(w.b, typeSHORT_BINARY_0+byte(l))
+	} else {
+		w.b = append(w.b, typeBINARY)
+		w.b = varint(w.b, uint(l))
+	}
+}
+
+// Int writes a signed integer value
+func (w *Writer) Int(i int64) {
+	w.b = w.e.encodeInt(w.b, reflect.Int, i)
+}
+
+// Uint writes an unsigned integer value
+func (w *Writer) Uint(u uint64) {
+	w.b = w.e.encodeInt(w.b, reflect.Uint, int64(u))
+}
+
+// Float32 writes a single precision floating point value
+func (w *Writer) Float32(f float32) {
+	w.b = w.e.encodeFloat(w.b, f)
+}
+
+// Float64 writes a double precision floating point value
+func (w *Writer) Float64(f float64) {
+	w.b = w.e.encodeDouble(w.b, f)
+}
+
+// Bool writes a boolean value
+func (w *Writer) Bool(b bool) {
+	if b {
+		w.b = append(w.b, typeTRUE)
+	} else {
+		w.b = append(w.b, typeFALSE)
+	}
+}
+
+// Struct writes a struct value implementing StructMarshaler itself
+func (w *Writer) Struct(m StructMarshaler) error {
+	if err := w.writeStruct(m); err != nil {
+		return prependPath(err, "."+w.key)
+	}
+
+	return nil
+}
+
+// StructElem writes element i of an array, a struct implementing
+// StructMarshaler itself
+func (w *Writer) StructElem(i int, m StructMarshaler) error {
+	if err := w.writeStruct(m); err != nil {
+		return prependPath(err, "."+w.key+"["+strconv.Itoa(i)+"]")
+	}
+
+	return nil
+}
+
+// StructEntry writes the value of the map entry key, a struct implementing
+// StructMarshaler itself
+func (w *Writer) StructEntry(key string, m StructMarshaler) error {
+	if err := w.writeStruct(m); err != nil {
+		return prependPath(err, "."+w.key+"["+strconv.Quote(key)+"]")
+	}
+
+	return nil
+}
+
+func (w *Writer) writeStruct(m StructMarshaler) error {
+	if w.e.typeEncoders != nil {
+		if _, ok := w.e.typeEncoders[reflect.TypeOf(m).Elem()]; ok {
+			return w.value(reflect.ValueOf(m).Elem())
+		}
+	}
+
+	var err error
+	w.b, err = w.e.encodeViaStructMarshaler(w.b, m, w.strTable, w.ptrTable, w.objTable)
+	return err
+}
+
+// Value writes any other value, the way the encoder would
+func (w *Writer) Value(v interface{}) error {
+	if err := w.value(v); err != nil {
+		return prependPath(err, "."+w.key)
+	}
+
+	return nil
+}
+
+func (w *Writer) value(v interface{}) error {
+	var err error
+	w.b, err = w.e.encode(w.b, v, false, false, w.strTable, w.ptrTable, w.objTable)
+	return err
+}
+
+// BeginArray writes the header of the slice s points to.  Its elements follow,
+// then End.  A slice written before is referred to instead, in which case
+// BeginArray returns false and nothing else is to be written.
+func (w *Writer) BeginArray(s interface{}) bool {
+	return w.begin(reflect.ValueOf(s).Elem(), false)
+}
+
+// BeginHash is BeginArray for the map m points to, whose entries are written
+// as a MapKey followed by the value
+func (w *Writer) BeginHash(m interface{}) bool {
+	return w.begin(reflect.ValueOf(m).Elem(), true)
+}
+
+func (w *Writer) begin(v reflect.Value, hash bool) bool {
+	key := containerKeyOf(v)
+
+	if c, ok := w.e.state.containers[key]; ok {
+		w.b = w.e.encodeSeenContainer(w.b, c, false)
+		return false
+	}
+
+	w.e.enter()
+
+	start := len(w.b)
+	if hash {
+		w.b = w.e.encodeHashHeader(w.b, v.Len(), false)
+	} else {
+		w.b = w.e.encodeArrayHeader(w.b, v.Len(), false)
+	}
+	w.e.trackContainer(w.b, start, key)
+
+	return true
+}
+
+// End follows the elements of an array or the entries of a hash
+func (w *Writer) End() error {
+	w.e.leave()
+	return w.Flush()
+}
+
+// Flush writes out what was written so far once enough of it is buffered,
+// when encoding to a stream
+func (w *Writer) Flush() error {
+	var err error
+	w.b, err = w.e.maybeFlush(w.b)
+	return err
+}
+
+// MapKey writes the key of the next map entry
+func (w *Writer) MapKey(key string) {
+	w.b = w.e.encodeString(w.b, key, true, w.strTable)
+}
+
+// Canonical reports whether map entries are to be written sorted by key
+func (w *Writer) Canonical() bool {
+	return w.e.Canonical
+}
+
+// findStructMarshaler returns the StructMarshaler of the struct st, if it has one
+func findStructMarshaler(st reflect.Value) (StructMarshaler, bool) {
+	if !reflect.PtrTo(st.Type()).Implements(structMarshalerType) {
+		return nil, false
+	}
+
+	if !st.CanAddr() {
+		p := reflect.New(st.Type())
+		p.Elem().Set(st)
+		st = p.Elem()
+	}
+
+	return st.Addr().Interface().(StructMarshaler), true
+}
+
+// encodeViaStructMarshaler has m write itself
+func (e *Encoder) encodeViaStructMarshaler(by []byte, m StructMarshaler, strTable map[string]int, ptrTable map[uintptr]int, objTable map[string]int) ([]byte, error) {
+	e.enter()
+
+	// the writer is shared with the struct being written, if any.  Should
+	// MarshalSereal fail or panic, the whole document is abandoned.
+	w := &e.state.writer
+	outer := *w
+
+	*w = Writer{e: e, typ: reflect.TypeOf(m), b: by, strTable: strTable, ptrTable: ptrTable, objTable: objTable}
+
+	if err := m.MarshalSereal(w); err != nil {
+		return nil, err
+	}
+
+	by = w.b
+	*w = outer
+	e.leave()
+
+	return by, nil
+}
@@ -40,16 +40,34 @@ func (c ZlibCompressor) compress(buf []byte) ([]byte, error) {
 	return append(head, tail...), nil
 }
 
-func (c ZlibCompressor) decompress(buf []byte) ([]byte, error) {
+func (c ZlibCompressor) decompress(buf []byte, max int) ([]byte, error) {
 	// Read the claimed length of the uncompressed document
-	uln, usz := varintdecode(buf)
+	uln, usz, err := readVarint(buf)
+	if err != nil {
+		return nil, err
+	}
 	buf = buf[usz:]
 
 	// Read the claimed length of the compressed document
-	cln, csz := varintdecode(buf)
+	cln, csz, err := readVarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	if cln < 0 || cln > len(buf)-csz {
+		return nil, ErrTruncated
+	}
 	buf = buf[csz : csz+cln]
 
-	// XXX Perhaps check if len(buf) == cln
+	// the uncompressed buffer is allocated up front, so don't trust a length
+	// deflate can't reach, which is 1032 times the compressed one.  No body
+	// is empty.
+	if uln <= 0 || cln == 0 || uln/1032 > cln {
+		return nil, ErrCorrupt{errBadUncompressedSize}
+	}
+
+	if err := checkLimit(ErrMaxUncompressedSize, max, uln); err != nil {
+		return nil, err
+	}
 
 	return zlibDecode(uln, buf)
 }
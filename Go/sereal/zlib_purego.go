@@ -5,6 +5,7 @@ package sereal
 import (
 	"bytes"
 	"compress/zlib"
+	"io"
 )
 
 func zlibEncode(buf []byte, level int) ([]byte, error) {
@@ -36,12 +37,17 @@ func zlibDecode(uln int, buf []byte) ([]byte, error) {
 	}
 	defer zr.Close()
 
-	dec := bytes.NewBuffer(make([]byte, 0, uln))
-	_, err = dec.ReadFrom(zr)
+	// read a byte more than claimed, so a document uncompressing to more
+	// than it said can't exhaust memory
+	dec := bytes.NewBuffer(make([]byte, 0, uln+1))
+	n, err := dec.ReadFrom(io.LimitReader(zr, int64(uln)+1))
 	if err != nil {
 		return nil, err
 	}
 
-	// XXX Perhaps check if the number of read bytes == uln
+	if n != int64(uln) {
+		return nil, ErrCorrupt{errBadUncompressedSize}
+	}
+
 	return dec.Bytes(), nil
 }